@@ -1,173 +1,3110 @@
-package main
-
-import (
-	"encoding/json"
-	"fmt"
-	"log"
-	"math/rand"
-	"net/http"
-	"regexp"
-	"strings"
-	"sync"
-	"time"
-)
-
-type SendCaptchaRequest struct {
-	Phone string `json:"phone"`
-}
-
-type VerifyCaptchaRequest struct {
-	Phone string `json:"phone"`
-	Code  string `json:"code"`
-}
-
-type CaptchaInfo struct {
-	Code     string    `json:"code"`
-	ExpireAt time.Time `json:"expire_at"`
-}
-
-var (
-	captchaStore = make(map[string]CaptchaInfo)
-	mu           sync.RWMutex
-	phoneRegex   = regexp.MustCompile(`^1[3-9]\d{9}$`)
-)
-
-func sendCaptchaHandler(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req SendCaptchaRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
-	req.Phone = strings.TrimSpace(req.Phone)
-	if !phoneRegex.MatchString(req.Phone) {
-		http.Error(w, "Invalid phone number", http.StatusBadRequest)
-		return
-	}
-
-	mu.RLock()
-	info, exists := captchaStore[req.Phone]
-	mu.RUnlock()
-
-	// 检查是否在冷却期（1分钟内重复发送）
-	if exists && info.ExpireAt.After(time.Now().Add(-1*time.Minute)) {
-		http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
-		return
-	}
-
-	// 生成6位随机验证码
-	code := rand.Intn(900000) + 100000
-	codeStr := fmt.Sprintf("%d", code)
-	expireAt := time.Now().Add(5 * time.Minute)
-
-	// 存储验证码（线程安全）
-	mu.Lock()
-	captchaStore[req.Phone] = CaptchaInfo{
-		Code:     codeStr,
-		ExpireAt: expireAt,
-	}
-	mu.Unlock()
-
-	// 调试信息（打印发送的验证码）
-	log.Printf("发送验证码：%s（手机号：%s，过期时间：%s）", codeStr, req.Phone, expireAt.Format("2006-01-02 15:04:05"))
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"code": 0,
-		"msg":  "Captcha sent successfully",
-	})
-}
-
-func verifyCaptchaHandler(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req VerifyCaptchaRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
-	req.Phone = strings.TrimSpace(req.Phone)
-	req.Code = strings.TrimSpace(req.Code)
-
-	if !phoneRegex.MatchString(req.Phone) {
-		http.Error(w, "Invalid phone number", http.StatusBadRequest)
-		return
-	}
-
-	if len(req.Code) != 6 {
-		http.Error(w, "Captcha must be 6 digits", http.StatusBadRequest)
-		return
-	}
-
-	// 线程安全读取
-	mu.RLock()
-	info, exists := captchaStore[req.Phone]
-	mu.RUnlock()
-
-	if !exists {
-		http.Error(w, "Captcha not found", http.StatusBadRequest)
-		return
-	}
-
-	if time.Now().After(info.ExpireAt) {
-		// 清理过期验证码
-		mu.Lock()
-		delete(captchaStore, req.Phone)
-		mu.Unlock()
-		http.Error(w, "Captcha expired", http.StatusBadRequest)
-		return
-	}
-
-	if info.Code != req.Code {
-		http.Error(w, "Invalid captcha", http.StatusBadRequest)
-		return
-	}
-
-	// 验证成功，清除验证码
-	mu.Lock()
-	delete(captchaStore, req.Phone)
-	mu.Unlock()
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"code": 0,
-		"msg":  "Captcha verified successfully",
-	})
-}
-
-func setCORSHeaders(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-}
-
-func main() {
-	rand.Seed(time.Now().UnixNano())
-	http.HandleFunc("/api/send-captcha", sendCaptchaHandler)
-	http.HandleFunc("/api/verify-captcha", verifyCaptchaHandler)
-	log.Println("Server starting on :8080...")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
-	}
-}
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type SendCaptchaRequest struct {
+	Phone     string `json:"phone"`
+	Length    int    `json:"length,omitempty"`    // 可选，超出允许范围时使用默认长度
+	Challenge string `json:"challenge,omitempty"` // 开启发送前挑战时，/api/challenge 返回的令牌
+	Solution  string `json:"solution,omitempty"`  // 挑战的解
+}
+
+type VerifyCaptchaRequest struct {
+	Phone string `json:"phone"`
+	Code  string `json:"code"`
+	Token string `json:"token,omitempty"` // 无状态模式下发送接口返回的令牌
+
+	SecretAnswer string `json:"secret_answer,omitempty"` // 开启密保问题校验时必填
+}
+
+// 兼容把验证码序列化成数字（123456）的客户端，按原样转成字符串。
+// 注意数字无法表示前导0：以0开头的验证码必须按字符串传，否则客户端那边就已经丢失了位数
+func (req *VerifyCaptchaRequest) UnmarshalJSON(data []byte) error {
+	type plain VerifyCaptchaRequest
+	var raw struct {
+		plain
+		Code json.RawMessage `json:"code"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*req = VerifyCaptchaRequest(raw.plain)
+	code := bytes.TrimSpace(raw.Code)
+	switch {
+	case len(code) == 0 || string(code) == "null":
+		req.Code = ""
+	case code[0] == '"':
+		return json.Unmarshal(code, &req.Code)
+	case digitsRegex.Match(code):
+		req.Code = string(code)
+	default:
+		return errors.New("code must be a string or a non-negative integer")
+	}
+	return nil
+}
+
+type BatchVerifyRequest struct {
+	Items []VerifyCaptchaRequest `json:"items"`
+}
+
+type PreissueRequest struct {
+	Phones []string `json:"phones"`
+	TTL    string   `json:"ttl,omitempty"` // 可选，如 "168h"，默认 CAPTCHA_OUT_OF_BAND_TTL
+}
+
+type PreissueResult struct {
+	Phone    string    `json:"phone"`
+	Code     string    `json:"code,omitempty"`
+	ExpireAt time.Time `json:"expire_at,omitzero"`
+	Msg      string    `json:"msg,omitempty"` // 号码无效时的原因
+}
+
+type BatchVerifyResult struct {
+	Phone   string `json:"phone"`
+	Success bool   `json:"success"`
+	Msg     string `json:"msg"`
+}
+
+type CaptchaInfo struct {
+	Code        string    `json:"code"`
+	SentAt      time.Time `json:"sent_at"`
+	ExpireAt    time.Time `json:"expire_at"`
+	Attempts    int       `json:"attempts"`              // 已输错的次数
+	MaxUses     int       `json:"max_uses"`              // 剩余可验证成功的次数，减到0时删除
+	Length      int       `json:"length"`                // 发送时实际使用的验证码长度
+	Verified    bool      `json:"verified"`              // 是否已验证成功过，可多次使用时统计只计一次
+	Fingerprint string    `json:"fingerprint,omitempty"` // 发送时客户端 IP 和 User-Agent 的哈希，未开启绑定时为空
+	OutOfBand   bool      `json:"out_of_band,omitempty"` // 管理员预先生成、线下分发的验证码，不触发发送冷却期，过期前不能被发送接口覆盖
+	Used        bool      `json:"used,omitempty"`        // 已用完但暂时保留，用于客户端重试验证时返回相同结果
+	Pending     bool      `json:"pending,omitempty"`     // 已预留但还没有下发完成，见 sendReservationTTL
+}
+
+// 验证码相关操作失败时返回的 HTTP 状态码和提示信息
+type captchaError struct {
+	status int
+	msg    string
+}
+
+// 可热更新的配置，收到 SIGHUP 时从 CAPTCHA_CONFIG_FILE 重新读取，校验通过后整体替换；
+// 处理请求时通过 currentConfig() 读取
+type runtimeConfig struct {
+	CaptchaTTL         time.Duration // 验证码有效期
+	SendCooldown       time.Duration // 同一手机号重复发送的冷却时间
+	MaxVerifyAttempts  int           // 最多可输错的次数
+	SendWindow         time.Duration // 发送次数限制的滑动窗口
+	SendWindowLimit    int           // 滑动窗口内每个手机号最多发送的次数，为0时不限制
+	ValidatePhoneLimit int           // 手机号格式校验接口每个 IP 每分钟最多请求的次数
+}
+
+// 配置文件格式，时长写成 "5m"、"60s" 这样的字符串，未填写的字段使用默认值
+type runtimeConfigFile struct {
+	CaptchaTTL         string `json:"captcha_ttl"`
+	SendCooldown       string `json:"send_cooldown"`
+	MaxVerifyAttempts  int    `json:"max_verify_attempts"`
+	SendWindow         string `json:"send_window"`
+	SendWindowLimit    *int   `json:"send_window_limit"`
+	ValidatePhoneLimit int    `json:"validate_phone_limit"`
+}
+
+var (
+	defaultRuntimeConfig = runtimeConfig{
+		CaptchaTTL:         5 * time.Minute,
+		SendCooldown:       1 * time.Minute,
+		MaxVerifyAttempts:  5,
+		ValidatePhoneLimit: 30,
+	}
+	activeConfig atomic.Pointer[runtimeConfig]
+	configFile   string
+)
+
+func init() {
+	cfg, _ := loadRuntimeConfig("")
+	activeConfig.Store(cfg)
+	rand.Read(lastCodesKey)
+}
+
+func currentConfig() *runtimeConfig {
+	return activeConfig.Load()
+}
+
+var (
+	captchaStore = make(map[string]CaptchaInfo)
+	mu           sync.RWMutex
+	phoneRegex   = regexp.MustCompile(`^1[3-9]\d{9}$`)
+	digitsRegex  = regexp.MustCompile(`^\d+$`)
+
+	// 客户端传入的关联 ID 只允许常见的 ID 字符，避免换行等内容写进日志
+	correlationIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+	// 用户粘贴验证码时常见的分隔符
+	codeSeparatorReplacer = strings.NewReplacer(" ", "", "-", "", ".", "", "\t", "")
+)
+
+// 管理员令牌，键为令牌，值为管理员名称（用于日志）
+var adminTokens = make(map[string]string)
+
+// 配置 CA 后管理接口接受该 CA 签发的客户端证书（仅 HTTPS），管理员名称取证书 CN；
+// adminRequireClientCert 为 true 时只认客户端证书，不再接受令牌
+var (
+	adminClientCAFile      string
+	adminRequireClientCert bool
+	adminClientCAs         *x509.CertPool // 由 validateConfig 从 adminClientCAFile 加载
+)
+
+const maxBatchVerifyItems = 100
+
+// 线下验证码：单次最多预生成的数量、默认有效期和允许的最长有效期
+const (
+	maxPreissueItems = 500
+	maxOutOfBandTTL  = 90 * 24 * time.Hour
+)
+
+var outOfBandTTL = 30 * 24 * time.Hour
+
+// 验证码格式配置
+var (
+	codeLength         = 6
+	minCodeLength      int // 请求可指定的验证码长度范围，默认都等于 codeLength
+	maxCodeLength      int
+	codeCharset        = "0123456789"
+	minCodeEntropyBits = 19.0 // 约等于6位纯数字，低于此值的配置启动时直接拒绝
+	allowWeakCode      bool   // 测试环境可显式跳过强度检查
+	codeDisplayMask    string // 短信中验证码的显示格式，# 代表一位验证码，如 "###-###"
+
+	// 生成验证码用的随机源，测试时可替换为固定内容的 Reader 以得到确定的验证码
+	codeRandom io.Reader = rand.Reader
+)
+
+// 每个手机号上一次下发的验证码（只存哈希），新验证码与之相同时重新生成，避免用户以为没有换新；
+// 哈希密钥在进程启动时随机生成，记录保留 lastCodeRetention 后由清理任务删除
+var (
+	lastCodes    = make(map[string]lastCode)
+	lastCodesMu  sync.Mutex
+	lastCodesKey = make([]byte, 32)
+)
+
+type lastCode struct {
+	hash     string
+	issuedAt time.Time
+}
+
+const (
+	lastCodeRetention       = 24 * time.Hour
+	maxCodeGenerateAttempts = 5
+)
+
+// 验证成功响应中额外返回的字段，可选 expire_at、phone（脱敏后）、token（仅无状态模式）
+var verifyResponseFields []string
+
+// 验证成功令牌的有效期，业务后端应在此时间内用它完成登录等后续操作
+const verifiedTokenTTL = 5 * time.Minute
+
+// 每个手机号最近一次验证成功的时间和所用验证码的哈希，保留 verifiedRetention 后清除，为0时不记录
+var (
+	lastVerified      = make(map[string]verifiedRecord)
+	lastVerifiedMu    sync.RWMutex
+	verifiedRetention = 24 * time.Hour
+
+	// 验证成功后的宽限期，期间同一手机号再次验证无需验证码，为0时关闭
+	reverifyGraceWindow time.Duration
+
+	// 验证码用完后继续保留的时长，期间用同一验证码重试验证仍返回成功，为0时用完立即删除
+	usedCodeRetention time.Duration
+
+	// 验证成功后这段时间内再次提交同一验证码时提示"已验证"而不是"验证码不存在"，为0时关闭（默认）
+	alreadyVerifiedWindow time.Duration
+)
+
+type verifiedRecord struct {
+	at          time.Time
+	codeHash    string // lastCodeHash(phone, code)，只有提交的验证码与之相同时才提示已验证
+	fingerprint string // 验证成功那次请求的指纹，强绑定时宽限期只对同一设备生效
+}
+
+const alreadyVerifiedMsg = "Phone number already verified"
+
+// 验证成功率的统计窗口（分钟）
+var (
+	statsWindowMinutes = 60
+	verifyStats        = newRateStats(statsWindowMinutes)
+)
+
+// 响应 JSON 的字段命名（snake 或 camel）和是否省略空值
+var (
+	jsonNaming    = "snake"
+	jsonOmitEmpty bool
+)
+
+// 允许跨域访问的来源，为空时允许所有来源
+var allowedOrigins []string
+
+// 预检结果的缓存时长（Access-Control-Max-Age），可按来源单独配置，
+// 格式为 来源=时长，如 https://app.example.com=1h；为0时不发送该响应头
+var (
+	corsMaxAge         time.Duration
+	corsMaxAgeEntries  []string
+	corsMaxAgeByOrigin map[string]time.Duration // 由 validateConfig 从 corsMaxAgeEntries 解析
+)
+
+// 一键作废成功时的状态码：204（默认）不返回响应体，200 返回 JSON，包含作废的数量
+var flushSuccessStatus = http.StatusNoContent
+
+// 开启后末尾带斜杠的路径不再等同于不带斜杠的路径
+var strictTrailingSlash bool
+
+// 无状态模式：发送接口返回签名令牌，验证时只校验令牌，不使用 captchaStore。
+// 发送冷却期按 sendHistory 中最近一次发送判断
+var (
+	statelessMode   bool
+	tokenSecret     []byte
+	statelessNonces = make(map[string]nonceState)
+	noncesMu        sync.Mutex
+	flushedAt       time.Time // 最近一次一键作废的时间，之前签发的令牌一律失效（受 noncesMu 保护）
+	// 已使用的挑战编号及其过期时间（受 noncesMu 保护）
+	spentChallenges = make(map[string]time.Time)
+)
+
+// 滑动窗口内每个手机号最多发送 sendWindowLimit 次，与单次发送的冷却期相互独立，为0时不限制。
+// 这里是启动时的取值，配置文件中的 send_window、send_window_limit 可以覆盖并热更新
+var (
+	sendWindow      = time.Hour
+	sendWindowLimit = 10
+	sendHistory     = make(map[string][]time.Time)
+	sendHistoryMu   sync.Mutex
+
+	sendHistoryMargin = 5 * time.Minute // 清理发送记录时在窗口之外额外保留的时长
+)
+
+// 发送时先在锁内写入 Pending 的验证码预留号码，下发完成后再确认；预留期间客户端重试返回409，
+// 不会生成第二个验证码。超过 sendReservationTTL 仍未确认的预留视为下发失败，允许重新发送
+var sendReservationTTL = 30 * time.Second
+
+const sendWindowExceededMsg = "Too many captchas requested for this phone, please try again later"
+
+// 发送接口的幂等记录，按 幂等键|手机号 保存 idempotencyTTL
+var (
+	idempotencyTTL  = 10 * time.Minute
+	idempotentSends = make(map[string]*idempotentSend)
+	idempotencyMu   sync.Mutex
+)
+
+const maxIdempotencyKeyLength = 255
+
+// 手机号格式校验接口的限流：每个 IP 每分钟最多 ValidatePhoneLimit 次
+var validatePhoneLimiter = newIPRateLimiter(time.Minute)
+
+// 号码类型查询，为 nil 时不查询；结果按号码缓存 lookupCacheTTL。
+// 配置了 voipPrefixes 时使用内置的号段查询
+var (
+	numberLookup   NumberLookup
+	voipPrefixes   []string
+	rejectVoIP     bool // 开启后拒绝向网络电话号码发送验证码
+	lookupCacheTTL = 24 * time.Hour
+	lookupCache    = make(map[string]lookupCacheEntry)
+	lookupCacheMu  sync.Mutex
+)
+
+// 同时配置证书和私钥时启用 HTTPS：httpAddr 上的明文请求一律重定向到 tlsAddr，
+// HTTPS 响应带 HSTS 头；未启用时只在 httpAddr 上提供明文服务，不发 HSTS
+var (
+	httpAddr              = ":8080"
+	tlsAddr               = ":8443"
+	tlsCertFile           string
+	tlsKeyFile            string
+	hstsMaxAge            = 180 * 24 * time.Hour
+	hstsIncludeSubDomains bool
+)
+
+// 发送前挑战的难度（要求哈希前导0比特数），为0时不要求挑战；挑战令牌用 tokenSecret 签名
+var (
+	challengeDifficulty int
+	challengeTTL        = 2 * time.Minute
+)
+
+// 开启后验证时除验证码外还要校验密保答案，答案由管理员接口按手机号设置
+var (
+	requireSecretAnswer bool
+	secretAnswers       = make(map[string]secretAnswerHash)
+	secretAnswersMu     sync.RWMutex
+)
+
+// 安全模式：验证接口的失败一律返回相同的400提示，且至少耗时 secureVerifyMinDuration
+var (
+	secureVerifyErrors      bool
+	secureVerifyMinDuration = 200 * time.Millisecond
+	verifyFailures          = make(map[string]int)
+	verifyFailuresMu        sync.Mutex
+)
+
+const secureVerifyFailedMsg = "Verification failed"
+
+// 免打扰时段（如 "22:00-08:00"，按 quietHoursTZ 的当地时间），期间拒绝发送验证码，为空时不限制。
+// 号码目前只支持 +86，所以只有一个时区
+var (
+	quietHours   string
+	quietHoursTZ = "Asia/Shanghai"
+	// 以下由 validateConfig 从 quietHours 解析
+	quietStart    time.Duration
+	quietEnd      time.Duration
+	quietLocation = time.Local
+)
+
+// 运行环境，默认按生产环境处理；只有非生产环境允许配置测试号码
+var appEnv = "production"
+
+// 测试号码（支持 * 号段前缀）不受发送冷却期和次数限制，可选固定验证码，仅用于 QA 和自动化测试
+var (
+	testPhones    []string
+	testPhoneCode string
+)
+
+// 请求体中无效 UTF-8 的处理方式：reject（默认）返回400，sanitize 替换为 U+FFFD
+var invalidUTF8Policy = "reject"
+
+const maxRequestBodyBytes = 1 << 20
+
+// 客户端传入关联 ID 的请求头，响应中用同名请求头带回
+var correlationHeader = "X-Correlation-ID"
+
+// 调试模式：开启后允许 ?pretty=true 输出缩进的 JSON，生产环境不要开启
+var debugMode bool
+
+// 是否在日志中打印验证码明文，仅供本地调试；开启后每 logCodeSampleRate 次发送打印一次，生产环境禁止开启
+var (
+	logCodes          bool
+	logCodeSampleRate = 1
+	logCodeCounter    atomic.Uint64
+)
+
+// 日志中手机号的处理方式：mask 脱敏（默认），hash 加盐哈希
+var (
+	logPhoneMode = "mask"
+	logPhoneSalt []byte
+)
+
+// 内部调用方（健康检查、内部服务）不受限流和冷却期限制：按连接地址所在网段或内部 API 密钥识别
+var (
+	internalCIDRs  []string
+	internalNets   []*net.IPNet // 由 validateConfig 从 internalCIDRs 解析
+	internalAPIKey string
+)
+
+// 验证码与客户端指纹的绑定方式：off 不绑定，soft 不一致时只记录日志，hard 不一致时拒绝
+var fingerprintBinding = "off"
+
+// 验证失败次数配置
+var (
+	captchaMaxUses          = 1  // 每个验证码可验证成功的次数，默认一次性使用
+	regenerateOnMaxAttempts bool // 输错次数达到上限时自动重新发送验证码，而不是直接作废
+)
+
+// 校验手机号前去掉的格式字符，CAPTCHA_PHONE_FORMAT_CHARS 设为空字符串时不去除
+var phoneFormatChars = " -().\u00a0"
+
+// 手机号黑白名单配置，条目以 * 结尾时按号段前缀匹配（如 170*）
+var (
+	phoneBlacklist []string
+	phoneWhitelist []string
+	whitelistOnly  bool // 开启后只允许白名单内的号码获取验证码
+)
+
+// 规范化手机号，返回作为存储键的11位号码；允许带 +86 国家码，
+// 先去掉 phoneFormatChars 中的格式字符，如 138-0013-8000、(138) 0013 8000
+func normalizePhone(raw string) (string, bool) {
+	phone := strings.TrimSpace(raw)
+	phone = strings.Map(func(c rune) rune {
+		if strings.ContainsRune(phoneFormatChars, c) {
+			return -1
+		}
+		return c
+	}, phone)
+	phone = strings.TrimPrefix(phone, "+86")
+	if !phoneRegex.MatchString(phone) {
+		return "", false
+	}
+	return phone, true
+}
+
+// 11位号码转为 E.164 格式，如 +8613800138000
+func e164Phone(phone string) string {
+	return "+86" + phone
+}
+
+// 只校验手机号格式并返回 E.164 格式，不发送验证码也不写入任何数据；按 IP 限流防止枚举
+func validatePhoneHandler(w http.ResponseWriter, r *http.Request) {
+	if caller, trusted := trustedCaller(r); trusted {
+		log.Printf("内部调用方 %s 跳过手机号校验限流", caller)
+	} else if limited := validatePhoneLimiter.allow(clientIP(r), currentConfig().ValidatePhoneLimit, time.Now()); limited != nil {
+		limited.Msg = "Too many requests, please try again later"
+		writeRateLimited(w, r, limited, time.Now())
+		return
+	}
+
+	var req SendCaptchaRequest
+	if err := decodeRequestBody(w, r, &req); err != nil {
+		http.Error(w, err.msg, err.status)
+		return
+	}
+
+	phone, ok := normalizePhone(req.Phone)
+	if !ok {
+		writeJSON(w, r, map[string]interface{}{
+			"code":  0,
+			"valid": false,
+		})
+		return
+	}
+	writeJSON(w, r, map[string]interface{}{
+		"code":  0,
+		"valid": true,
+		"e164":  e164Phone(phone),
+	})
+}
+
+// 返回前端渲染输入框和倒计时所需的公开配置；只包含验证码格式和时长，不返回任何密钥或下发渠道信息
+func captchaConfigHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	writeJSON(w, r, map[string]interface{}{
+		"code":             0,
+		"code_length":      codeLength,
+		"min_code_length":  minCodeLength,
+		"max_code_length":  maxCodeLength,
+		"numeric":          codeIsNumeric(),
+		"ttl_seconds":      int64(cfg.CaptchaTTL / time.Second),
+		"cooldown_seconds": int64(cfg.SendCooldown / time.Second),
+	})
+}
+
+// 按固定时间窗口统计每个 IP 的请求次数，次数上限由调用方每次传入，便于热更新
+type ipRateLimiter struct {
+	mu     sync.Mutex
+	window time.Duration
+	hits   map[string]ipWindow
+}
+
+type ipWindow struct {
+	start time.Time
+	count int
+}
+
+func newIPRateLimiter(window time.Duration) *ipRateLimiter {
+	return &ipRateLimiter{window: window, hits: make(map[string]ipWindow)}
+}
+
+// 未超限时记下本次请求并返回 nil，超限时返回限流详情
+func (l *ipRateLimiter) allow(ip string, limit int, now time.Time) *rateLimitDetail {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hit := l.hits[ip]
+	if now.Sub(hit.start) >= l.window {
+		hit = ipWindow{start: now}
+	}
+	if hit.count >= limit {
+		return &rateLimitDetail{Limit: "ip", Used: hit.count, Max: limit, ResetAt: hit.start.Add(l.window)}
+	}
+	hit.count++
+	l.hits[ip] = hit
+	return nil
+}
+
+// 清除已经结束的时间窗口
+func (l *ipRateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, hit := range l.hits {
+		if now.Sub(hit.start) >= l.window {
+			delete(l.hits, ip)
+		}
+	}
+}
+
+// 取连接的对端地址，不信任可伪造的 X-Forwarded-For
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// 判断请求是否来自可信的内部调用方：连接地址在内部网段内，或带有正确的内部 API 密钥。
+// 只看 RemoteAddr，不信任 X-Forwarded-For 等客户端可伪造的请求头
+func trustedCaller(r *http.Request) (string, bool) {
+	if internalAPIKey != "" {
+		if key := r.Header.Get("X-Internal-Api-Key"); key != "" &&
+			subtle.ConstantTimeCompare([]byte(key), []byte(internalAPIKey)) == 1 {
+			return "api-key@" + clientIP(r), true
+		}
+	}
+	if ip := net.ParseIP(clientIP(r)); ip != nil {
+		for _, network := range internalNets {
+			if network.Contains(ip) {
+				return ip.String(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// 判断手机号是否命中名单中的号码或号段
+func matchPhoneList(phone string, list []string) bool {
+	for _, entry := range list {
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok {
+			if strings.HasPrefix(phone, prefix) {
+				return true
+			}
+		} else if phone == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// 查询号码的运营商和线路类型，由接入的号码查询服务实现
+type NumberLookup interface {
+	Lookup(phone string) (NumberInfo, error)
+}
+
+type NumberInfo struct {
+	Carrier  string
+	LineType LineType
+}
+
+type LineType string
+
+const (
+	LineTypeMobile   LineType = "mobile"
+	LineTypeVoIP     LineType = "voip"
+	LineTypeLandline LineType = "landline"
+	LineTypeUnknown  LineType = "unknown"
+)
+
+// 按号段判断网络电话号码，命中 voipPrefixes 的为 VoIP，其余号码类型未知
+type prefixLookup []string
+
+func (l prefixLookup) Lookup(phone string) (NumberInfo, error) {
+	if matchPhoneList(phone, l) {
+		return NumberInfo{LineType: LineTypeVoIP}, nil
+	}
+	return NumberInfo{LineType: LineTypeUnknown}, nil
+}
+
+type lookupCacheEntry struct {
+	info     NumberInfo
+	expireAt time.Time
+}
+
+// 按配置检查号码类型；查询服务出错时放行，避免第三方故障导致无法发送
+func checkNumberLineType(phone string, now time.Time) *captchaError {
+	if numberLookup == nil || !rejectVoIP {
+		return nil
+	}
+	info, err := lookupNumber(phone, now)
+	if err != nil {
+		log.Printf("号码类型查询失败（手机号：%s）：%v", logPhone(phone), err)
+		return nil
+	}
+	if info.LineType == LineTypeVoIP {
+		return &captchaError{http.StatusForbidden, "VoIP numbers are not supported"}
+	}
+	return nil
+}
+
+// 带缓存的号码查询，减少调用第三方服务的次数
+func lookupNumber(phone string, now time.Time) (NumberInfo, error) {
+	lookupCacheMu.Lock()
+	entry, ok := lookupCache[phone]
+	lookupCacheMu.Unlock()
+	if ok && now.Before(entry.expireAt) {
+		return entry.info, nil
+	}
+
+	info, err := numberLookup.Lookup(phone)
+	if err != nil {
+		return NumberInfo{}, err
+	}
+	lookupCacheMu.Lock()
+	lookupCache[phone] = lookupCacheEntry{info: info, expireAt: now.Add(lookupCacheTTL)}
+	lookupCacheMu.Unlock()
+	return info, nil
+}
+
+// 清除过期的号码查询缓存
+func pruneLookupCache(now time.Time) {
+	lookupCacheMu.Lock()
+	defer lookupCacheMu.Unlock()
+	for phone, entry := range lookupCache {
+		if !now.Before(entry.expireAt) {
+			delete(lookupCache, phone)
+		}
+	}
+}
+
+func isPhoneBlocked(phone string) bool {
+	if matchPhoneList(phone, phoneBlacklist) {
+		return true
+	}
+	return whitelistOnly && !matchPhoneList(phone, phoneWhitelist)
+}
+
+func sendCaptchaHandler(w http.ResponseWriter, r *http.Request) {
+	var req SendCaptchaRequest
+	if err := decodeRequestBody(w, r, &req); err != nil {
+		http.Error(w, err.msg, err.status)
+		return
+	}
+
+	phone, ok := normalizePhone(req.Phone)
+	if !ok {
+		http.Error(w, "Invalid phone number", http.StatusBadRequest)
+		return
+	}
+	req.Phone = phone
+
+	// 同一幂等键重复发送时直接返回第一次的结果，不再下发短信；键按手机号隔离
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+		entry, replay := beginIdempotentSend(key+"|"+req.Phone, time.Now())
+		if replay {
+			entry.replay(w)
+			return
+		}
+		rec := &responseRecorder{ResponseWriter: w}
+		defer finishIdempotentSend(key+"|"+req.Phone, entry, rec, time.Now())
+		w = rec
+	}
+
+	// 黑名单或不在白名单内的号码直接拒绝
+	if isPhoneBlocked(req.Phone) {
+		http.Error(w, "Phone number is not allowed", http.StatusForbidden)
+		return
+	}
+
+	if err := checkNumberLineType(req.Phone, time.Now()); err != nil {
+		http.Error(w, err.msg, err.status)
+		return
+	}
+
+	// 内部调用方不受冷却期和发送次数限制，但每次都记录日志以便审计
+	caller, trusted := trustedCaller(r)
+	if trusted {
+		log.Printf("内部调用方 %s 跳过发送限制（手机号：%s）", caller, logPhone(req.Phone))
+	} else if err := checkChallenge(req.Phone, req.Challenge, req.Solution, time.Now()); err != nil {
+		http.Error(w, err.msg, err.status)
+		return
+	}
+	// 测试号码同样不受冷却期和发送次数限制，便于自动化测试反复发送
+	unlimited := trusted || isTestPhone(req.Phone)
+
+	// 免打扰时段内暂停下发，告诉客户端多久后可以重试
+	if remaining, quiet := quietHoursRemaining(time.Now()); quiet {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+		http.Error(w, "Captcha delivery is paused during quiet hours", http.StatusServiceUnavailable)
+		return
+	}
+
+	// 整个发送过程使用同一份配置，避免热更新发生在中途时冷却期判断和返回的解除时间不一致
+	cfg := currentConfig()
+
+	// 无状态模式下不写入 captchaStore，验证码以签名令牌的形式交给客户端保存
+	if statelessMode {
+		if !unlimited {
+			if limited := recordStatelessSend(req.Phone, cfg, time.Now()); limited != nil {
+				writeRateLimited(w, r, limited, time.Now())
+				return
+			}
+		}
+		token, info, err := issueStatelessCaptcha(req.Phone, cfg, time.Now(), requestedCodeLength(req.Length), requestFingerprint(r))
+		if err != nil {
+			log.Printf("生成验证码失败：%v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		reference := deliverCaptcha(req.Phone, info)
+		writeJSON(w, r, map[string]interface{}{
+			"code":      0,
+			"msg":       "Captcha sent successfully",
+			"token":     token,
+			"reference": reference,
+		})
+		return
+	}
+
+	// 冷却期检查和预留放在同一把写锁内，避免客户端重试的并发请求都通过检查而生成两个验证码
+	now := time.Now()
+	mu.Lock()
+	info, exists := captchaStore[req.Phone]
+	if exists && info.Pending {
+		if now.Before(info.SentAt.Add(sendReservationTTL)) {
+			mu.Unlock()
+			http.Error(w, "Captcha delivery already in progress", http.StatusConflict)
+			return
+		}
+		// 预留已超时，上一次下发没有完成，不再按冷却期拦截
+		exists = false
+	}
+	if exists && info.OutOfBand && !isExpired(info, now) {
+		mu.Unlock()
+		http.Error(w, "A pre-issued captcha is pending for this phone", http.StatusConflict)
+		return
+	}
+	if !unlimited && exists && inCooldown(info, cfg, now) {
+		mu.Unlock()
+		writeRateLimited(w, r, &rateLimitDetail{
+			Limit:   "cooldown",
+			Used:    1,
+			Max:     1,
+			ResetAt: info.SentAt.Add(cfg.SendCooldown),
+			Msg:     "Too many requests, please try again later",
+		}, now)
+		return
+	}
+	if !unlimited {
+		if limited := recordSendInWindow(req.Phone, cfg, now); limited != nil {
+			mu.Unlock()
+			writeRateLimited(w, r, limited, now)
+			return
+		}
+	}
+	info, err := issueCaptchaLocked(req.Phone, cfg, now, requestedCodeLength(req.Length), requestFingerprint(r))
+	if err != nil {
+		mu.Unlock()
+		log.Printf("生成验证码失败：%v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	info.Pending = true
+	captchaStore[req.Phone] = info
+	mu.Unlock()
+
+	reference := deliverCaptcha(req.Phone, info)
+	confirmDelivery(req.Phone, info)
+
+	writeJSON(w, r, map[string]interface{}{
+		"code":      0,
+		"msg":       "Captcha sent successfully",
+		"reference": reference,
+	})
+}
+
+func verifyCaptchaHandler(w http.ResponseWriter, r *http.Request) {
+	var req VerifyCaptchaRequest
+	if err := decodeRequestBody(w, r, &req); err != nil {
+		http.Error(w, err.msg, err.status)
+		return
+	}
+
+	start := time.Now()
+	info, err := verifyCaptchaRequest(req, requestFingerprint(r))
+	if err != nil {
+		recordVerifyFailure(err.msg)
+		// 安全模式下所有失败统一返回，并补齐到固定耗时，避免从提示或响应时间判断号码是否有待验证的验证码
+		if secureVerifyErrors {
+			// 按规范化后的号码记录，同一号码不同格式的输入在 hash 模式下得到相同的哈希
+			logged := "invalid"
+			if phone, ok := normalizePhone(req.Phone); ok {
+				logged = logPhone(phone)
+			}
+			log.Printf("验证失败（手机号：%s）：%s", logged, err.msg)
+			time.Sleep(time.Until(start.Add(secureVerifyMinDuration)))
+			http.Error(w, secureVerifyFailedMsg, http.StatusBadRequest)
+			return
+		}
+		// 输错次数达到上限，验证码已作废，需要重新获取，没有固定的解除时间
+		if err.status == http.StatusTooManyRequests {
+			attempts := currentConfig().MaxVerifyAttempts
+			writeRateLimited(w, r, &rateLimitDetail{Limit: "verify_attempts", Used: attempts, Max: attempts, Msg: err.msg}, time.Now())
+			return
+		}
+		http.Error(w, err.msg, err.status)
+		return
+	}
+
+	phone, _ := normalizePhone(req.Phone)
+	writeJSON(w, r, composeVerifyResponse(phone, info))
+}
+
+// 组装验证成功的响应，默认只有 code 和 msg，可按配置附加字段
+func composeVerifyResponse(phone string, info CaptchaInfo) map[string]interface{} {
+	resp := map[string]interface{}{
+		"code": 0,
+		"msg":  "Captcha verified successfully",
+	}
+	for _, field := range verifyResponseFields {
+		switch field {
+		case "expire_at":
+			resp["expire_at"] = info.ExpireAt
+		case "phone":
+			resp["phone"] = maskPhone(phone)
+		case "token":
+			resp["token"] = signVerifiedToken(phone, time.Now())
+		}
+	}
+	return resp
+}
+
+// 手机号脱敏，如 13800138000 -> 138****8000
+func maskPhone(phone string) string {
+	if len(phone) < 7 {
+		return "****"
+	}
+	return phone[:3] + strings.Repeat("*", len(phone)-7) + phone[len(phone)-4:]
+}
+
+// 日志中的手机号一律经过这里：mask 模式脱敏为 138****8000，hash 模式输出加盐哈希，
+// 同一号码的哈希相同，便于按号码关联日志而不暴露号码本身
+func logPhone(phone string) string {
+	if logPhoneMode == "hash" {
+		return hashPhone(phone)
+	}
+	return maskPhone(phone)
+}
+
+func hashPhone(phone string) string {
+	mac := hmac.New(sha256.New, logPhoneSalt)
+	mac.Write([]byte(phone))
+	return "h:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// 按当前模式校验验证请求；单个验证和批量验证共用
+// fingerprint 为空时不校验设备绑定（如管理员批量验证）
+func verifyCaptchaRequest(req VerifyCaptchaRequest, fingerprint string) (CaptchaInfo, *captchaError) {
+	if statelessMode {
+		return verifyStatelessCaptcha(req.Phone, req.Code, req.Token, req.SecretAnswer, fingerprint)
+	}
+	return verifyCaptcha(req.Phone, req.Code, req.SecretAnswer, fingerprint)
+}
+
+// 校验手机号和验证码，成功时消费验证码并返回其信息
+func verifyCaptcha(phone, code, answer, fingerprint string) (CaptchaInfo, *captchaError) {
+	phone, ok := normalizePhone(phone)
+	if !ok {
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Invalid phone number"}
+	}
+	code = normalizeCode(strings.TrimSpace(code))
+
+	// 刚验证成功的手机号在宽限期内再次验证时直接通过，避免前端丢失结果后只能重新发短信；
+	// 有新的待验证验证码时仍按正常流程校验
+	if withinReverifyGrace(phone, fingerprint, time.Now()) {
+		return CaptchaInfo{Verified: true}, nil
+	}
+
+	if n := utf8.RuneCountInString(code); n < minCodeLength || n > maxCodeLength {
+		return CaptchaInfo{}, codeLengthError(minCodeLength, maxCodeLength)
+	}
+
+	// 线程安全读取
+	mu.RLock()
+	info, exists := captchaStore[phone]
+	mu.RUnlock()
+
+	if !exists {
+		// 验证成功后记录已删除，重复提交时给出明确提示
+		if recentlyVerified(phone, code, time.Now()) {
+			return CaptchaInfo{}, &captchaError{http.StatusConflict, alreadyVerifiedMsg}
+		}
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Captcha not found"}
+	}
+
+	if isExpired(info, time.Now()) {
+		// 清理过期验证码
+		mu.Lock()
+		delete(captchaStore, phone)
+		mu.Unlock()
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Captcha expired"}
+	}
+
+	// 按该验证码发送时的长度校验，而不是全局默认长度
+	if utf8.RuneCountInString(code) != info.Length {
+		return CaptchaInfo{}, codeLengthError(info.Length, info.Length)
+	}
+
+	if err := checkFingerprint(phone, info.Fingerprint, fingerprint); err != nil {
+		return CaptchaInfo{}, err
+	}
+
+	// 验证码和密保答案任一错误都按输错处理，提示相同，不透露是哪一项错了
+	answerOK := secretAnswerMatches(phone, answer)
+	// 已用完但仍在保留期内：同一验证码重试直接返回成功，其他验证码一律拒绝且不计输错次数
+	if info.Used {
+		if info.Code == code && answerOK {
+			return info, nil
+		}
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Captcha already used"}
+	}
+	if info.Code != code || !answerOK {
+		// 在写锁内重新读取，保证并发输错时次数不会丢失
+		mu.Lock()
+		current, ok := captchaStore[phone]
+		if !ok || current.Code != info.Code {
+			mu.Unlock()
+			return CaptchaInfo{}, &captchaError{http.StatusBadRequest, invalidCaptchaMsg()}
+		}
+		cfg := currentConfig()
+		current.Attempts++
+		if current.Attempts < cfg.MaxVerifyAttempts {
+			captchaStore[phone] = current
+			mu.Unlock()
+			return CaptchaInfo{}, &captchaError{http.StatusBadRequest, invalidCaptchaMsg()}
+		}
+
+		// 达到最大尝试次数，作废当前验证码；开启自动重发且满足发送限制时下发新验证码
+		delete(captchaStore, phone)
+		mu.Unlock()
+		if regenerateOnMaxAttempts && reissueCaptcha(phone, current, cfg, time.Now()) {
+			return CaptchaInfo{}, &captchaError{http.StatusTooManyRequests, "Too many failed attempts, a new captcha has been sent"}
+		}
+		return CaptchaInfo{}, &captchaError{http.StatusTooManyRequests, "Too many failed attempts, please request a new captcha"}
+	}
+
+	// 验证成功，扣减剩余次数，用完后清除验证码；在写锁内重新读取，避免并发请求重复使用最后一次
+	mu.Lock()
+	defer mu.Unlock()
+	current, ok := captchaStore[phone]
+	if !ok {
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Captcha not found"}
+	}
+	if current.Code != code {
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Invalid captcha"}
+	}
+	if !current.Verified {
+		current.Verified = true
+		verifyStats.record(time.Now(), 0, 1)
+	}
+	recordVerified(phone, code, fingerprint, time.Now())
+	current.MaxUses--
+	switch {
+	case current.MaxUses > 0:
+		captchaStore[phone] = current
+	case usedCodeRetention > 0:
+		// 保留到 usedCodeRetention 后由清理任务删除，不延长原有效期
+		current.Used = true
+		if retainUntil := time.Now().Add(usedCodeRetention); retainUntil.Before(current.ExpireAt) {
+			current.ExpireAt = retainUntil
+		}
+		captchaStore[phone] = current
+	default:
+		delete(captchaStore, phone)
+	}
+	return current, nil
+}
+
+// 密保答案只保存加盐的 PBKDF2 哈希
+type secretAnswerHash struct {
+	salt []byte
+	hash []byte
+}
+
+const secretAnswerIterations = 100000
+
+func hashSecretAnswer(answer string, salt []byte) []byte {
+	key, _ := pbkdf2.Key(sha256.New, normalizeSecretAnswer(answer), salt, secretAnswerIterations, 32)
+	return key
+}
+
+// 答案忽略首尾空格和大小写
+func normalizeSecretAnswer(answer string) string {
+	return strings.ToLower(strings.TrimSpace(answer))
+}
+
+// 未开启密保校验时总是通过；号码没有设置答案时按错误处理，同样计算一次哈希，避免从耗时看出是否设置过
+func secretAnswerMatches(phone, answer string) bool {
+	if !requireSecretAnswer {
+		return true
+	}
+	secretAnswersMu.RLock()
+	stored, ok := secretAnswers[phone]
+	secretAnswersMu.RUnlock()
+	if !ok {
+		hashSecretAnswer(answer, make([]byte, 16))
+		return false
+	}
+	return subtle.ConstantTimeCompare(hashSecretAnswer(answer, stored.salt), stored.hash) == 1
+}
+
+func invalidCaptchaMsg() string {
+	if requireSecretAnswer {
+		return "Invalid captcha or secret answer"
+	}
+	return "Invalid captcha"
+}
+
+// 管理员设置（PUT）或删除（DELETE ?phone=）手机号的密保答案
+func secretAnswerHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := authenticateAdmin(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		phone, ok := normalizePhone(r.URL.Query().Get("phone"))
+		if !ok {
+			http.Error(w, "Invalid phone number", http.StatusBadRequest)
+			return
+		}
+		secretAnswersMu.Lock()
+		delete(secretAnswers, phone)
+		secretAnswersMu.Unlock()
+		log.Printf("管理员 %s 删除了手机号 %s 的密保答案", admin, logPhone(phone))
+		writeJSON(w, r, map[string]interface{}{
+			"code": 0,
+			"msg":  "Secret answer deleted",
+		})
+		return
+	}
+
+	var req struct {
+		Phone  string `json:"phone"`
+		Answer string `json:"answer"`
+	}
+	if err := decodeRequestBody(w, r, &req); err != nil {
+		http.Error(w, err.msg, err.status)
+		return
+	}
+	phone, ok := normalizePhone(req.Phone)
+	if !ok {
+		http.Error(w, "Invalid phone number", http.StatusBadRequest)
+		return
+	}
+	if normalizeSecretAnswer(req.Answer) == "" {
+		http.Error(w, "Secret answer must not be empty", http.StatusBadRequest)
+		return
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	secretAnswersMu.Lock()
+	secretAnswers[phone] = secretAnswerHash{salt: salt, hash: hashSecretAnswer(req.Answer, salt)}
+	secretAnswersMu.Unlock()
+	log.Printf("管理员 %s 设置了手机号 %s 的密保答案", admin, logPhone(phone))
+	writeJSON(w, r, map[string]interface{}{
+		"code": 0,
+		"msg":  "Secret answer saved",
+	})
+}
+
+// 批量校验手机号和验证码，仅限管理员调用，避免被当作暴力破解的接口
+func verifyCaptchaBatchHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := authenticateAdmin(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req BatchVerifyRequest
+	if err := decodeRequestBody(w, r, &req); err != nil {
+		http.Error(w, err.msg, err.status)
+		return
+	}
+
+	if len(req.Items) == 0 || len(req.Items) > maxBatchVerifyItems {
+		http.Error(w, fmt.Sprintf("Items must contain 1 to %d entries", maxBatchVerifyItems), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BatchVerifyResult, 0, len(req.Items))
+	for _, item := range req.Items {
+		// 号码无效时原样返回输入，方便调用方对应到请求中的条目
+		phone, ok := normalizePhone(item.Phone)
+		if !ok {
+			phone = item.Phone
+		}
+		result := BatchVerifyResult{Phone: phone, Success: true, Msg: "Captcha verified successfully"}
+		if _, err := verifyCaptchaRequest(item, ""); err != nil {
+			result.Success = false
+			result.Msg = err.msg
+		}
+		results = append(results, result)
+	}
+	log.Printf("管理员 %s 批量验证了 %d 个验证码", admin, len(results))
+
+	writeJSON(w, r, map[string]interface{}{
+		"code":    0,
+		"msg":     "Batch verification completed",
+		"results": results,
+	})
+}
+
+// 为线下场景（自助终端、纸质分发）预先生成验证码，不发短信，验证码直接返回给管理员；
+// 有效期默认较长，不受发送冷却期和滑动窗口限制，验证流程与普通验证码相同。
+// 验证或过期之前，公开的发送接口不会用新的验证码覆盖它（返回409）；
+// 需要提前改用短信时，管理员用 DELETE ?phone= 撤销该号码的线下验证码
+func preissueCaptchaHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := authenticateAdmin(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if statelessMode {
+		http.Error(w, "Pre-issued captchas are not supported in stateless mode", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		phone, ok := normalizePhone(r.URL.Query().Get("phone"))
+		if !ok {
+			http.Error(w, "Invalid phone number", http.StatusBadRequest)
+			return
+		}
+		// 只撤销线下验证码，短信发出的验证码不受影响
+		mu.Lock()
+		info, exists := captchaStore[phone]
+		revoked := exists && info.OutOfBand
+		if revoked {
+			delete(captchaStore, phone)
+		}
+		mu.Unlock()
+		if !revoked {
+			http.Error(w, "Pre-issued captcha not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("管理员 %s 撤销了手机号 %s 的线下验证码", admin, logPhone(phone))
+		writeJSON(w, r, map[string]interface{}{
+			"code": 0,
+			"msg":  "Pre-issued captcha revoked",
+		})
+		return
+	}
+
+	var req PreissueRequest
+	if err := decodeRequestBody(w, r, &req); err != nil {
+		http.Error(w, err.msg, err.status)
+		return
+	}
+
+	if len(req.Phones) == 0 || len(req.Phones) > maxPreissueItems {
+		http.Error(w, fmt.Sprintf("Phones must contain 1 to %d entries", maxPreissueItems), http.StatusBadRequest)
+		return
+	}
+	ttl := outOfBandTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 || d > maxOutOfBandTTL {
+			http.Error(w, fmt.Sprintf("TTL must be a positive duration up to %s", maxOutOfBandTTL), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	now := time.Now()
+	cfg := currentConfig()
+	results := make([]PreissueResult, 0, len(req.Phones))
+	mu.Lock()
+	for _, raw := range req.Phones {
+		phone, ok := normalizePhone(raw)
+		if !ok {
+			results = append(results, PreissueResult{Phone: raw, Msg: "Invalid phone number"})
+			continue
+		}
+		info, err := issueCaptchaLocked(phone, cfg, now, codeLength, "")
+		if err != nil {
+			mu.Unlock()
+			log.Printf("生成验证码失败：%v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		info.ExpireAt = now.Add(ttl)
+		info.OutOfBand = true
+		captchaStore[phone] = info
+		results = append(results, PreissueResult{Phone: phone, Code: info.Code, ExpireAt: info.ExpireAt})
+	}
+	mu.Unlock()
+	log.Printf("管理员 %s 预生成了 %d 个线下验证码，有效期 %s", admin, len(results), ttl)
+
+	writeJSON(w, r, map[string]interface{}{
+		"code":    0,
+		"msg":     "Captchas pre-issued successfully",
+		"results": results,
+	})
+}
+
+// 先校验客户端证书，再校验 Authorization: Bearer <token>，返回对应的管理员名称
+func authenticateAdmin(r *http.Request) (string, bool) {
+	if name, ok := authenticateClientCert(r); ok {
+		return name, true
+	}
+	if adminRequireClientCert {
+		return "", false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	for adminToken, name := range adminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// 握手时只请求不强制客户端证书，在这里按配置的 CA 校验，缺少或无效的证书返回 401 而不是握手失败
+func authenticateClientCert(r *http.Request) (string, bool) {
+	if adminClientCAs == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+	certs := r.TLS.PeerCertificates
+	opts := x509.VerifyOptions{
+		Roots:         adminClientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		log.Printf("管理接口客户端证书校验失败（%s）：%v", certs[0].Subject.CommonName, err)
+		return "", false
+	}
+	return "cert:" + certs[0].Subject.CommonName, true
+}
+
+// 无状态令牌中携带的内容，验证码只保存带密钥的哈希
+type statelessClaims struct {
+	Phone       string `json:"phone"`
+	CodeHash    string `json:"code_hash"`
+	Length      int    `json:"len"`
+	IssuedAt    int64  `json:"iat"` // 纳秒时间戳，用于一键作废之前签发的令牌
+	ExpireAt    int64  `json:"exp"`
+	Nonce       string `json:"jti"`
+	Fingerprint string `json:"fp,omitempty"`
+}
+
+// 验证成功令牌：业务后端用同一个 CAPTCHA_TOKEN_SECRET 校验签名，即可确认号码刚通过验证，
+// 不需要回调验证码服务
+type verifiedClaims struct {
+	Type     string `json:"typ"` // 固定为 verified，避免与验证码令牌、挑战令牌混用
+	Phone    string `json:"phone"`
+	IssuedAt int64  `json:"iat"`
+	ExpireAt int64  `json:"exp"`
+}
+
+func signVerifiedToken(phone string, now time.Time) string {
+	return signToken(verifiedClaims{
+		Type:     "verified",
+		Phone:    phone,
+		IssuedAt: now.Unix(),
+		ExpireAt: now.Add(verifiedTokenTTL).Unix(),
+	})
+}
+
+// 带 Idempotency-Key 的发送结果。处理中的请求 done 尚未关闭，同键的并发请求等它完成后回放结果；
+// 只保存成功的结果，失败时删除记录，客户端用同一个键重试会重新处理
+type idempotentSend struct {
+	done        chan struct{}
+	stored      bool
+	status      int
+	contentType string
+	body        []byte
+	expireAt    time.Time
+}
+
+// 取出幂等键对应的结果，第二个返回值为 true 时应回放；否则已登记为处理中，调用方处理完必须调用 finishIdempotentSend
+func beginIdempotentSend(key string, now time.Time) (*idempotentSend, bool) {
+	for {
+		idempotencyMu.Lock()
+		entry, ok := idempotentSends[key]
+		if !ok || (entry.stored && !now.Before(entry.expireAt)) {
+			entry = &idempotentSend{done: make(chan struct{})}
+			idempotentSends[key] = entry
+			idempotencyMu.Unlock()
+			return entry, false
+		}
+		idempotencyMu.Unlock()
+		<-entry.done
+		if entry.stored {
+			return entry, true
+		}
+	}
+}
+
+func finishIdempotentSend(key string, entry *idempotentSend, rec *responseRecorder, now time.Time) {
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+	if rec.status >= 200 && rec.status < 300 {
+		entry.stored = true
+		entry.status = rec.status
+		entry.contentType = rec.Header().Get("Content-Type")
+		entry.body = rec.body.Bytes()
+		entry.expireAt = now.Add(idempotencyTTL)
+	} else if idempotentSends[key] == entry {
+		// 处理期间记录可能已被一键作废清掉，不能误删之后同键登记的新记录
+		delete(idempotentSends, key)
+	}
+	close(entry.done)
+}
+
+func (e *idempotentSend) replay(w http.ResponseWriter) {
+	// 只回放内容类型，CORS 等响应头按本次请求重新生成
+	w.Header().Set("Content-Type", e.contentType)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// 清除已过期的幂等记录，处理中的记录不动
+func pruneIdempotentSends(now time.Time) {
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+	for key, entry := range idempotentSends {
+		if entry.stored && !now.Before(entry.expireAt) {
+			delete(idempotentSends, key)
+		}
+	}
+}
+
+// 记录写出的状态码和响应体，同时照常写给客户端
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// 已出现过的令牌编号，用于防止重放和限制输错次数，令牌过期后清除
+type nonceState struct {
+	expireAt time.Time
+	attempts int
+	used     bool
+}
+
+// 发送前的工作量证明挑战：客户端找到 solution，使 SHA-256(challenge + ":" + solution)
+// 的前 difficulty 个比特都为0。挑战令牌带签名、绑定手机号，服务端只记录已使用的挑战编号，
+// 同一个解不能重复用于发送
+type challengeClaims struct {
+	Type       string `json:"typ"` // 固定为 challenge，避免与验证码令牌混用
+	Phone      string `json:"phone"`
+	Difficulty int    `json:"difficulty"`
+	ExpireAt   int64  `json:"exp"`
+	Nonce      string `json:"jti"`
+}
+
+// 签发挑战，未开启时返回 difficulty 为0，客户端可以直接发送
+func challengeHandler(w http.ResponseWriter, r *http.Request) {
+	if challengeDifficulty <= 0 {
+		writeJSON(w, r, map[string]interface{}{
+			"code":       0,
+			"difficulty": 0,
+		})
+		return
+	}
+	phone, ok := normalizePhone(r.URL.Query().Get("phone"))
+	if !ok {
+		http.Error(w, "Invalid phone number", http.StatusBadRequest)
+		return
+	}
+	expireAt := time.Now().Add(challengeTTL)
+	token := signToken(challengeClaims{
+		Type:       "challenge",
+		Phone:      phone,
+		Difficulty: challengeDifficulty,
+		ExpireAt:   expireAt.Unix(),
+		Nonce:      newNonce(),
+	})
+	writeJSON(w, r, map[string]interface{}{
+		"code":       0,
+		"challenge":  token,
+		"difficulty": challengeDifficulty,
+		"expire_at":  expireAt,
+	})
+}
+
+// 校验发送请求附带的挑战解；难度以签发时为准，调整配置不影响已签发的挑战
+func checkChallenge(phone, token, solution string, now time.Time) *captchaError {
+	if challengeDifficulty <= 0 {
+		return nil
+	}
+	if token == "" || solution == "" {
+		return &captchaError{http.StatusBadRequest, "Challenge solution required"}
+	}
+	var claims challengeClaims
+	if err := parseToken(token, &claims); err != nil || claims.Type != "challenge" || claims.Phone != phone {
+		return &captchaError{http.StatusBadRequest, "Invalid challenge"}
+	}
+	if !now.Before(time.Unix(claims.ExpireAt, 0)) {
+		return &captchaError{http.StatusBadRequest, "Challenge expired"}
+	}
+	sum := sha256.Sum256([]byte(token + ":" + solution))
+	if leadingZeroBits(sum[:]) < claims.Difficulty {
+		return &captchaError{http.StatusBadRequest, "Invalid challenge solution"}
+	}
+
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+	if _, spent := spentChallenges[claims.Nonce]; spent {
+		return &captchaError{http.StatusBadRequest, "Challenge already used"}
+	}
+	spentChallenges[claims.Nonce] = time.Unix(claims.ExpireAt, 0)
+	return nil
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c == 0 {
+			n += 8
+			continue
+		}
+		for c&0x80 == 0 {
+			n++
+			c <<= 1
+		}
+		break
+	}
+	return n
+}
+
+// 生成验证码并签发无状态令牌
+func issueStatelessCaptcha(phone string, cfg *runtimeConfig, now time.Time, length int, fingerprint string) (string, CaptchaInfo, error) {
+	code, err := codeForPhone(phone, length)
+	if err != nil {
+		return "", CaptchaInfo{}, err
+	}
+	info := CaptchaInfo{
+		Code:     code,
+		SentAt:   now,
+		ExpireAt: now.Add(cfg.CaptchaTTL),
+		MaxUses:  1,
+		Length:   length,
+	}
+	nonce := newNonce()
+	token := signToken(statelessClaims{
+		Phone:       phone,
+		CodeHash:    statelessCodeHash(nonce, phone, info.Code),
+		Length:      length,
+		IssuedAt:    now.UnixNano(),
+		ExpireAt:    info.ExpireAt.Unix(),
+		Nonce:       nonce,
+		Fingerprint: fingerprint,
+	})
+	verifyStats.record(now, 1, 0)
+	return token, info, nil
+}
+
+// 校验签名、有效期和验证码，不查询 captchaStore
+func verifyStatelessCaptcha(phone, code, token, answer, fingerprint string) (CaptchaInfo, *captchaError) {
+	phone, ok := normalizePhone(phone)
+	if !ok {
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Invalid phone number"}
+	}
+	code = normalizeCode(strings.TrimSpace(code))
+	if token == "" {
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Captcha token required"}
+	}
+
+	var claims statelessClaims
+	if err := parseToken(token, &claims); err != nil || claims.Phone != phone || claims.Nonce == "" {
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Invalid captcha token"}
+	}
+	now := time.Now()
+	info := CaptchaInfo{Code: code, ExpireAt: time.Unix(claims.ExpireAt, 0), Length: claims.Length}
+	if isExpired(info, now) {
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Captcha expired"}
+	}
+	if utf8.RuneCountInString(code) != claims.Length {
+		return CaptchaInfo{}, codeLengthError(claims.Length, claims.Length)
+	}
+	if err := checkFingerprint(phone, claims.Fingerprint, fingerprint); err != nil {
+		return CaptchaInfo{}, err
+	}
+
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+	if claims.IssuedAt <= flushedAt.UnixNano() {
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Captcha expired"}
+	}
+	state, ok := statelessNonces[claims.Nonce]
+	if !ok {
+		state = nonceState{expireAt: info.ExpireAt}
+	}
+	if state.used {
+		if recentlyVerified(phone, code, now) {
+			return CaptchaInfo{}, &captchaError{http.StatusConflict, alreadyVerifiedMsg}
+		}
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, "Captcha already used"}
+	}
+	answerOK := secretAnswerMatches(phone, answer)
+	if !hmac.Equal([]byte(statelessCodeHash(claims.Nonce, phone, code)), []byte(claims.CodeHash)) || !answerOK {
+		state.attempts++
+		if state.attempts >= currentConfig().MaxVerifyAttempts {
+			state.used = true
+			statelessNonces[claims.Nonce] = state
+			return CaptchaInfo{}, &captchaError{http.StatusTooManyRequests, "Too many failed attempts, please request a new captcha"}
+		}
+		statelessNonces[claims.Nonce] = state
+		return CaptchaInfo{}, &captchaError{http.StatusBadRequest, invalidCaptchaMsg()}
+	}
+
+	state.used = true
+	statelessNonces[claims.Nonce] = state
+	verifyStats.record(now, 0, 1)
+	recordVerified(phone, code, fingerprint, now)
+	info.Verified = true
+	return info, nil
+}
+
+// 清除已过期令牌的编号记录
+func pruneStatelessNonces(now time.Time) {
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+	for nonce, state := range statelessNonces {
+		if !now.Before(state.expireAt) {
+			delete(statelessNonces, nonce)
+		}
+	}
+}
+
+// 清除已过期挑战的使用记录，过期的挑战本身已无法通过校验
+func pruneSpentChallenges(now time.Time) {
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+	for nonce, expireAt := range spentChallenges {
+		if !now.Before(expireAt) {
+			delete(spentChallenges, nonce)
+		}
+	}
+}
+
+// 验证码哈希带上服务端密钥，避免拿到令牌后离线穷举验证码
+func statelessCodeHash(nonce, phone, code string) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(nonce + "|" + phone + "|" + code))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 签发令牌：base64url(JSON) + "." + base64url(HMAC-SHA256)
+func signToken(claims interface{}) string {
+	data, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 校验令牌签名并解析内容
+func parseToken(token string, claims interface{}) error {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return errors.New("malformed token")
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("invalid token signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, claims)
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 检查滑动窗口内的发送次数，未超限时记下本次发送并返回 nil，超限时返回限流详情
+func recordSendInWindow(phone string, cfg *runtimeConfig, now time.Time) *rateLimitDetail {
+	if cfg.SendWindowLimit <= 0 {
+		return nil
+	}
+	sendHistoryMu.Lock()
+	defer sendHistoryMu.Unlock()
+	return recordSendLocked(phone, cfg, now)
+}
+
+// 无状态模式没有 captchaStore，冷却期按最近一次发送的时间判断；冷却期和滑动窗口的检查与记录在同一把锁内完成
+func recordStatelessSend(phone string, cfg *runtimeConfig, now time.Time) *rateLimitDetail {
+	sendHistoryMu.Lock()
+	defer sendHistoryMu.Unlock()
+	history := sendHistory[phone]
+	if n := len(history); n > 0 {
+		if resetAt := history[n-1].Add(cfg.SendCooldown); now.Before(resetAt) {
+			return &rateLimitDetail{
+				Limit:   "cooldown",
+				Used:    1,
+				Max:     1,
+				ResetAt: resetAt,
+				Msg:     "Too many requests, please try again later",
+			}
+		}
+	}
+	if cfg.SendWindowLimit <= 0 {
+		// 不限制窗口内次数时只保留最近一次，供冷却期判断
+		sendHistory[phone] = []time.Time{now}
+		return nil
+	}
+	return recordSendLocked(phone, cfg, now)
+}
+
+// 调用方需持有 sendHistoryMu
+func recordSendLocked(phone string, cfg *runtimeConfig, now time.Time) *rateLimitDetail {
+	// 记录按时间先后排列，去掉窗口之外的部分
+	history := sendHistory[phone]
+	cutoff := now.Add(-cfg.SendWindow)
+	i := 0
+	for i < len(history) && !history[i].After(cutoff) {
+		i++
+	}
+	history = history[i:]
+	if len(history) >= cfg.SendWindowLimit {
+		sendHistory[phone] = history
+		log.Printf("手机号 %s 在 %s 内请求验证码超过 %d 次，已拦截", logPhone(phone), cfg.SendWindow, cfg.SendWindowLimit)
+		return &rateLimitDetail{
+			Limit:   "send_window",
+			Used:    len(history),
+			Max:     cfg.SendWindowLimit,
+			ResetAt: history[0].Add(cfg.SendWindow),
+			Msg:     sendWindowExceededMsg,
+		}
+	}
+	sendHistory[phone] = append(history, now)
+	return nil
+}
+
+// 由清理任务定期调用：清除早于 窗口+余量 的发送记录，长期不再发送的号码整条删除。
+// 无状态模式按最近一次发送判断冷却期，冷却期比窗口长时按冷却期保留。
+// 窗口内的次数判断仍由 recordSendInWindow 负责，这里只回收内存
+func pruneSendHistory(now time.Time) {
+	sendHistoryMu.Lock()
+	defer sendHistoryMu.Unlock()
+	cfg := currentConfig()
+	retention := cfg.SendWindow
+	if cooldown := cfg.SendCooldown; cooldown > retention {
+		retention = cooldown
+	}
+	cutoff := now.Add(-(retention + sendHistoryMargin))
+	for phone, history := range sendHistory {
+		i := 0
+		for i < len(history) && !history[i].After(cutoff) {
+			i++
+		}
+		switch {
+		case i == len(history):
+			delete(sendHistory, phone)
+		case i > 0:
+			// 复制一份，释放前面已过期记录占用的底层数组
+			sendHistory[phone] = append([]time.Time(nil), history[i:]...)
+		}
+	}
+}
+
+// 限流和配额超限的详情，所有429响应都按这个结构返回，方便客户端提示还有多久可以重试
+type rateLimitDetail struct {
+	Limit   string    // 超出的限制：cooldown、send_window、ip、verify_attempts
+	Used    int       // 当前已用次数
+	Max     int       // 允许的次数
+	ResetAt time.Time // 限制解除的时间，为零值时表示需要重新获取验证码
+	Msg     string
+}
+
+func writeRateLimited(w http.ResponseWriter, r *http.Request, d *rateLimitDetail, now time.Time) {
+	resp := map[string]interface{}{
+		"code":  http.StatusTooManyRequests,
+		"msg":   d.Msg,
+		"limit": d.Limit,
+		"used":  d.Used,
+		"max":   d.Max,
+	}
+	if !d.ResetAt.IsZero() {
+		retryAfter := int(math.Ceil(d.ResetAt.Sub(now).Seconds()))
+		if retryAfter < 0 {
+			retryAfter = 0
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		resp["reset_at"] = d.ResetAt
+		resp["retry_after"] = retryAfter
+	}
+	writeJSONStatus(w, r, http.StatusTooManyRequests, resp)
+}
+
+// 计算客户端指纹（IP 和 User-Agent 的哈希），未开启绑定时返回空字符串
+func requestFingerprint(r *http.Request) string {
+	if fingerprintBinding == "off" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(clientIP(r) + "|" + r.UserAgent()))
+	return hex.EncodeToString(sum[:])
+}
+
+// 校验验证时的指纹是否与发送时一致；强绑定时拒绝，弱绑定时只记录日志
+func checkFingerprint(phone, bound, actual string) *captchaError {
+	if bound == "" || actual == "" || bound == actual {
+		return nil
+	}
+	if fingerprintBinding == "hard" {
+		return &captchaError{http.StatusBadRequest, "Captcha was requested from a different device"}
+	}
+	log.Printf("验证设备与发送设备不一致（手机号：%s），弱绑定模式下放行", logPhone(phone))
+	return nil
+}
+
+// 过期时刻本身即视为已过期：ExpireAt 为 T 的验证码在 T 及之后都不能再使用。
+// 所有判断验证码是否过期的地方都应调用这里，不要各自比较时间
+func isExpired(info CaptchaInfo, now time.Time) bool {
+	return !now.Before(info.ExpireAt)
+}
+
+// 清除已过期但一直没有验证的验证码
+func pruneExpiredCaptchas(now time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	for phone, info := range captchaStore {
+		if isExpired(info, now) {
+			delete(captchaStore, phone)
+		}
+	}
+}
+
+// 判断当前是否处于免打扰时段，是则返回距离时段结束的时长；时段可以跨越午夜（如 22:00-08:00）
+func quietHoursRemaining(now time.Time) (time.Duration, bool) {
+	if quietHours == "" {
+		return 0, false
+	}
+	local := now.In(quietLocation)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, quietLocation)
+	elapsed := local.Sub(midnight)
+	var inside bool
+	if quietStart < quietEnd {
+		inside = elapsed >= quietStart && elapsed < quietEnd
+	} else {
+		inside = elapsed >= quietStart || elapsed < quietEnd
+	}
+	if !inside {
+		return 0, false
+	}
+	end := midnight.Add(quietEnd)
+	if !end.After(local) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end.Sub(local), true
+}
+
+// 解析 "HH:MM" 为距离午夜的时长
+func parseClock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// 判断是否仍在发送冷却期内
+func inCooldown(info CaptchaInfo, cfg *runtimeConfig, now time.Time) bool {
+	if info.OutOfBand {
+		return false
+	}
+	return now.Before(info.SentAt.Add(cfg.SendCooldown))
+}
+
+// 请求指定的长度在允许范围内时使用之，否则使用默认长度
+func requestedCodeLength(length int) int {
+	if length >= minCodeLength && length <= maxCodeLength {
+		return length
+	}
+	return codeLength
+}
+
+func codeLengthError(min, max int) *captchaError {
+	unit := "characters"
+	if codeIsNumeric() {
+		unit = "digits"
+	}
+	if min == max {
+		return &captchaError{http.StatusBadRequest, fmt.Sprintf("Captcha must be %d %s", min, unit)}
+	}
+	return &captchaError{http.StatusBadRequest, fmt.Sprintf("Captcha must be %d to %d %s", min, max, unit)}
+}
+
+// 按指定长度和配置的字符集生成随机验证码，随机数来自 codeRandom
+func generateCode(length int) (string, error) {
+	charset := []rune(codeCharset)
+	max := big.NewInt(int64(len(charset)))
+	code := make([]rune, length)
+	for i := range code {
+		n, err := rand.Int(codeRandom, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = charset[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// 字符集是否全为数字
+func codeIsNumeric() bool {
+	return digitsRegex.MatchString(codeCharset)
+}
+
+// 验证码强度（比特）= 长度 × log2(字符集大小)，重复字符只计一次
+func codeEntropyBits(length int) float64 {
+	unique := make(map[rune]bool)
+	for _, c := range codeCharset {
+		unique[c] = true
+	}
+	return float64(length) * math.Log2(float64(len(unique)))
+}
+
+// 测试号码配置了固定验证码且长度一致时使用固定验证码，其余情况随机生成
+func codeForPhone(phone string, length int) (string, error) {
+	if testPhoneCode != "" && isTestPhone(phone) && utf8.RuneCountInString(testPhoneCode) == length {
+		return testPhoneCode, nil
+	}
+
+	lastCodesMu.Lock()
+	defer lastCodesMu.Unlock()
+	previous := lastCodes[phone].hash
+	var code, hash string
+	// 有限次数内与上一次相同则重新生成，仍相同时照常使用（字符集很小时可能发生）
+	for i := 0; i < maxCodeGenerateAttempts; i++ {
+		var err error
+		if code, err = generateCode(length); err != nil {
+			return "", err
+		}
+		if hash = lastCodeHash(phone, code); hash != previous {
+			break
+		}
+	}
+	lastCodes[phone] = lastCode{hash: hash, issuedAt: time.Now()}
+	return code, nil
+}
+
+func lastCodeHash(phone, code string) string {
+	mac := hmac.New(sha256.New, lastCodesKey)
+	mac.Write([]byte(phone + ":" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func pruneLastCodes(now time.Time) {
+	lastCodesMu.Lock()
+	defer lastCodesMu.Unlock()
+	for phone, last := range lastCodes {
+		if !now.Before(last.issuedAt.Add(lastCodeRetention)) {
+			delete(lastCodes, phone)
+		}
+	}
+}
+
+// 生产环境下启动校验已拒绝测试号码配置，这里再判断一次，确保不会因配置遗漏而放行
+func isTestPhone(phone string) bool {
+	return appEnv != "production" && matchPhoneList(phone, testPhones)
+}
+
+// 输错次数用尽后自动重发。与正常发送一样受黑名单、号码类型、免打扰时段、冷却期和
+// 滑动窗口次数的限制，任一不满足或已有新的验证码时返回 false，由调用方按普通锁定处理
+func reissueCaptcha(phone string, previous CaptchaInfo, cfg *runtimeConfig, now time.Time) bool {
+	if isPhoneBlocked(phone) || checkNumberLineType(phone, now) != nil {
+		return false
+	}
+	if _, quiet := quietHoursRemaining(now); quiet || inCooldown(previous, cfg, now) {
+		return false
+	}
+
+	mu.Lock()
+	if _, exists := captchaStore[phone]; exists {
+		mu.Unlock()
+		return false
+	}
+	if limited := recordSendInWindow(phone, cfg, now); limited != nil {
+		mu.Unlock()
+		return false
+	}
+	info, err := issueCaptchaLocked(phone, cfg, now, previous.Length, previous.Fingerprint)
+	mu.Unlock()
+	if err != nil {
+		log.Printf("生成验证码失败：%v", err)
+		return false
+	}
+	deliverCaptcha(phone, info)
+	return true
+}
+
+// 生成指定长度的随机验证码并写入存储（调用方需持有写锁）
+func issueCaptchaLocked(phone string, cfg *runtimeConfig, now time.Time, length int, fingerprint string) (CaptchaInfo, error) {
+	code, err := codeForPhone(phone, length)
+	if err != nil {
+		return CaptchaInfo{}, err
+	}
+	info := CaptchaInfo{
+		Code:        code,
+		SentAt:      now,
+		ExpireAt:    now.Add(cfg.CaptchaTTL),
+		MaxUses:     captchaMaxUses,
+		Length:      length,
+		Fingerprint: fingerprint,
+	}
+	captchaStore[phone] = info
+	verifyStats.record(now, 1, 0)
+	return info, nil
+}
+
+func recordVerified(phone, code, fingerprint string, now time.Time) {
+	if verifiedRetention <= 0 {
+		return
+	}
+	lastVerifiedMu.Lock()
+	lastVerified[phone] = verifiedRecord{at: now, codeHash: lastCodeHash(phone, code), fingerprint: fingerprint}
+	lastVerifiedMu.Unlock()
+}
+
+// 查询手机号最近一次验证成功的时间，超过保留期的视为不存在
+func lastVerifiedAt(phone string, now time.Time) (time.Time, bool) {
+	record, ok := lastVerifiedRecord(phone, now)
+	return record.at, ok
+}
+
+func lastVerifiedRecord(phone string, now time.Time) (verifiedRecord, bool) {
+	lastVerifiedMu.RLock()
+	record, ok := lastVerified[phone]
+	lastVerifiedMu.RUnlock()
+	if !ok || !now.Before(record.at.Add(verifiedRetention)) {
+		return verifiedRecord{}, false
+	}
+	return record, true
+}
+
+// 强绑定时换了设备不能借宽限期跳过验证码，按正常流程校验
+func withinReverifyGrace(phone, fingerprint string, now time.Time) bool {
+	if reverifyGraceWindow <= 0 {
+		return false
+	}
+	record, ok := lastVerifiedRecord(phone, now)
+	if !ok || !now.Before(record.at.Add(reverifyGraceWindow)) {
+		return false
+	}
+	if fingerprintBinding == "hard" && record.fingerprint != fingerprint {
+		return false
+	}
+	mu.RLock()
+	info, pending := captchaStore[phone]
+	mu.RUnlock()
+	return !pending || info.Used
+}
+
+// 窗口内提交的是刚验证成功的那个验证码时返回 true，其他验证码照常按不存在处理
+func recentlyVerified(phone, code string, now time.Time) bool {
+	if alreadyVerifiedWindow <= 0 {
+		return false
+	}
+	record, ok := lastVerifiedRecord(phone, now)
+	return ok && now.Before(record.at.Add(alreadyVerifiedWindow)) &&
+		hmac.Equal([]byte(record.codeHash), []byte(lastCodeHash(phone, code)))
+}
+
+// 删除手机号的验证记录（用户申请删除个人数据时使用）
+func forgetVerified(phone string) bool {
+	lastVerifiedMu.Lock()
+	defer lastVerifiedMu.Unlock()
+	_, ok := lastVerified[phone]
+	delete(lastVerified, phone)
+	return ok
+}
+
+// 清除超过保留期的验证记录
+func pruneLastVerified(now time.Time) {
+	lastVerifiedMu.Lock()
+	defer lastVerifiedMu.Unlock()
+	for phone, record := range lastVerified {
+		if !now.Before(record.at.Add(verifiedRetention)) {
+			delete(lastVerified, phone)
+		}
+	}
+}
+
+// 查询或删除手机号的最近验证时间，仅限管理员调用
+func verifiedHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := authenticateAdmin(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	phone, ok := normalizePhone(r.URL.Query().Get("phone"))
+	if !ok {
+		http.Error(w, "Invalid phone number", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		forgetVerified(phone)
+		log.Printf("管理员 %s 删除了手机号 %s 的验证记录", admin, logPhone(phone))
+		writeJSON(w, r, map[string]interface{}{
+			"code": 0,
+			"msg":  "Verification record deleted",
+		})
+		return
+	}
+
+	at, ok := lastVerifiedAt(phone, time.Now())
+	if !ok {
+		http.Error(w, "Verification record not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, r, map[string]interface{}{
+		"code":        0,
+		"phone":       phone,
+		"verified_at": at,
+	})
+}
+
+// 安全事件时一键作废所有未使用的验证码，仅限管理员调用
+func flushHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := authenticateAdmin(r)
+	if !ok {
+		log.Printf("未授权的一键作废请求（来源：%s）", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	mu.Lock()
+	flushed := len(captchaStore)
+	captchaStore = make(map[string]CaptchaInfo)
+	mu.Unlock()
+
+	noncesMu.Lock()
+	flushedAt = time.Now()
+	statelessNonces = make(map[string]nonceState)
+	noncesMu.Unlock()
+
+	// 免验证窗口和幂等回放都不能越过作废继续生效
+	lastVerifiedMu.Lock()
+	clear(lastVerified)
+	lastVerifiedMu.Unlock()
+
+	idempotencyMu.Lock()
+	clear(idempotentSends)
+	idempotencyMu.Unlock()
+
+	log.Printf("管理员 %s 作废了全部验证码，共 %d 个（来源：%s）", admin, flushed, r.RemoteAddr)
+	if flushSuccessStatus == http.StatusNoContent {
+		// CORS 响应头已由 allowMethods 设置
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, map[string]interface{}{
+		"code":    0,
+		"msg":     "All captchas have been invalidated",
+		"flushed": flushed,
+	})
+}
+
+// 后台定期清理过期数据
+func runJanitor(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		pruneExpiredCaptchas(now)
+		pruneLastVerified(now)
+		pruneStatelessNonces(now)
+		pruneSpentChallenges(now)
+		pruneLookupCache(now)
+		pruneIdempotentSends(now)
+		pruneSendHistory(now)
+		pruneLastCodes(now)
+		validatePhoneLimiter.prune(now)
+	}
+}
+
+// 按分钟分桶统计发送和验证成功次数，桶数等于窗口分钟数，内存占用固定
+type rateStats struct {
+	mu      sync.Mutex
+	buckets []statsBucket
+}
+
+type statsBucket struct {
+	minute   int64
+	sent     int
+	verified int
+}
+
+func newRateStats(windowMinutes int) *rateStats {
+	return &rateStats{buckets: make([]statsBucket, windowMinutes)}
+}
+
+func (s *rateStats) record(now time.Time, sent, verified int) {
+	minute := now.Unix() / 60
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := &s.buckets[minute%int64(len(s.buckets))]
+	if b.minute != minute {
+		// 桶里是上一轮窗口的旧数据，直接覆盖
+		*b = statsBucket{minute: minute}
+	}
+	b.sent += sent
+	b.verified += verified
+}
+
+// 统计窗口内的发送数和验证成功数
+func (s *rateStats) totals(now time.Time) (sent, verified int) {
+	minute := now.Unix() / 60
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.buckets {
+		if b.minute <= minute && minute-b.minute < int64(len(s.buckets)) {
+			sent += b.sent
+			verified += b.verified
+		}
+	}
+	return sent, verified
+}
+
+// 返回统计窗口内的验证成功率，仅限管理员调用
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authenticateAdmin(r); !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sent, verified := verifyStats.totals(time.Now())
+	rate := 0.0
+	if sent > 0 {
+		rate = float64(verified) / float64(sent)
+	}
+
+	writeJSON(w, r, map[string]interface{}{
+		"code":           0,
+		"window_minutes": len(verifyStats.buckets),
+		"sent":           sent,
+		"verified":       verified,
+		"success_rate":   rate,
+		"failures":       verifyFailureCounts(),
+	})
+}
+
+// 按原因累计验证失败次数（自进程启动起），安全模式下对外统一提示，具体原因只在这里和日志中保留
+func recordVerifyFailure(reason string) {
+	verifyFailuresMu.Lock()
+	verifyFailures[reason]++
+	verifyFailuresMu.Unlock()
+}
+
+func verifyFailureCounts() map[string]int {
+	verifyFailuresMu.Lock()
+	defer verifyFailuresMu.Unlock()
+	counts := make(map[string]int, len(verifyFailures))
+	for reason, n := range verifyFailures {
+		counts[reason] = n
+	}
+	return counts
+}
+
+// 下发验证码，目前只打印调试信息；短信中的验证码按显示格式分组，存储和比对仍用原始值。
+// 返回本次发送的参考编号，用户反馈收不到验证码时凭它在日志中查找，编号与验证码无关，可以公开
+func deliverCaptcha(phone string, info CaptchaInfo) string {
+	reference := newSendReference()
+	log.Printf("发送验证码（手机号：%s，过期时间：%s，参考编号：%s）", logPhone(phone), info.ExpireAt.Format("2006-01-02 15:04:05"), reference)
+	if shouldLogCode() {
+		log.Printf("[debug] 验证码：%s（参考编号：%s）", formatCodeForDisplay(info.Code), reference)
+	}
+	return reference
+}
+
+// 是否打印本次发送的验证码：需显式开启且不在生产环境，并按采样率每 N 次打印一次，避免高负载下刷屏
+func shouldLogCode() bool {
+	if !logCodes || appEnv == "production" {
+		return false
+	}
+	return (logCodeCounter.Add(1)-1)%uint64(logCodeSampleRate) == 0
+}
+
+// 下发完成后确认预留；期间验证码已被替换或删除时不做处理
+func confirmDelivery(phone string, info CaptchaInfo) {
+	mu.Lock()
+	defer mu.Unlock()
+	current, ok := captchaStore[phone]
+	if ok && current.Pending && current.Code == info.Code && current.SentAt.Equal(info.SentAt) {
+		current.Pending = false
+		captchaStore[phone] = current
+	}
+}
+
+// 生成发送参考编号，独立随机生成，不能从中推出验证码或手机号
+func newSendReference() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "snd_" + hex.EncodeToString(b)
+}
+
+// 按显示格式填充验证码，如 "###-###" 把 123456 显示为 123-456；
+// 格式中 # 的个数与验证码长度不一致时（如请求指定了其他长度）原样返回
+func formatCodeForDisplay(code string) string {
+	chars := []rune(code)
+	if codeDisplayMask == "" || strings.Count(codeDisplayMask, "#") != len(chars) {
+		return code
+	}
+	var b strings.Builder
+	i := 0
+	for _, c := range codeDisplayMask {
+		if c == '#' {
+			b.WriteRune(chars[i])
+			i++
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// 为路由声明允许的请求方法，统一处理 CORS、OPTIONS 预检和 405（附带 Allow 头）
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(append(methods[:len(methods):len(methods)], http.MethodOptions), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 允许的来源或缓存时长随来源变化时，告诉缓存按 Origin 区分响应；
+		// 不带 Origin 的响应同样要设置，否则缓存下来的响应会被带 Origin 的请求复用
+		if len(allowedOrigins) > 0 || len(corsMaxAgeByOrigin) > 0 {
+			w.Header().Add("Vary", "Origin")
+		}
+		// 没有 Origin 的请求（移动端、curl 等）不受 CORS 约束，直接放行，鉴权和限流照常进行
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if !originAllowed(origin) {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			setCORSHeaders(w, origin, allow, preflight)
+		}
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		for _, m := range methods {
+			if r.Method == m {
+				handler(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// 未配置允许的来源时保持原来的 * 行为
+func originAllowed(origin string) bool {
+	if len(allowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// 只有 OPTIONS 且带 Access-Control-Request-Method 的才是真正的预检请求
+func setCORSHeaders(w http.ResponseWriter, origin, allow string, preflight bool) {
+	if len(allowedOrigins) == 0 {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if preflight {
+		maxAge, ok := corsMaxAgeByOrigin[origin]
+		if !ok {
+			maxAge = corsMaxAge
+		}
+		if maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge/time.Second)))
+		}
+		w.Header().Set("Access-Control-Allow-Methods", allow)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, "+correlationHeader)
+	} else {
+		// 让浏览器端脚本能读到响应中的关联 ID
+		w.Header().Set("Access-Control-Expose-Headers", correlationHeader)
+	}
+}
+
+// 解析 JSON 请求体，所有接口共用。无效的 UTF-8 字节和不成对的代理项转义（如 "\ud800"）
+// 按 invalidUTF8Policy 处理：reject 返回400，sanitize 替换为 U+FFFD 后继续解析
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, v interface{}) *captchaError {
+	defer r.Body.Close()
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return &captchaError{http.StatusRequestEntityTooLarge, "Request body too large"}
+		}
+		return &captchaError{http.StatusBadRequest, "Invalid request body"}
+	}
+	if !utf8.Valid(data) || hasLoneSurrogateEscape(data) {
+		if invalidUTF8Policy == "reject" {
+			return &captchaError{http.StatusBadRequest, "Request body is not valid UTF-8"}
+		}
+		// 不成对的代理项转义由 encoding/json 自动替换为 U+FFFD
+		data = bytes.ToValidUTF8(data, []byte("\uFFFD"))
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return &captchaError{http.StatusBadRequest, "Invalid request body"}
+	}
+	return nil
+}
+
+// 检查 JSON 文本中是否有不成对的 \uD800-\uDFFF 转义
+func hasLoneSurrogateEscape(data []byte) bool {
+	expectLow := false
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\\' || i+1 >= len(data) {
+			if expectLow {
+				return true
+			}
+			continue
+		}
+		if data[i+1] != 'u' || i+6 > len(data) {
+			if expectLow {
+				return true
+			}
+			i++ // 跳过 \\、\" 等两字节转义
+			continue
+		}
+		n, err := strconv.ParseUint(string(data[i+2:i+6]), 16, 16)
+		i += 5
+		if err != nil {
+			continue
+		}
+		switch {
+		case n >= 0xD800 && n <= 0xDBFF:
+			if expectLow {
+				return true
+			}
+			expectLow = true
+		case n >= 0xDC00 && n <= 0xDFFF:
+			if !expectLow {
+				return true
+			}
+			expectLow = false
+		default:
+			if expectLow {
+				return true
+			}
+		}
+	}
+	return expectLow
+}
+
+// 按全局的字段命名和空值策略输出 JSON 响应，所有接口共用
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	writeJSONStatus(w, r, http.StatusOK, v)
+}
+
+// 同 writeJSON，但使用指定的状态码（如429的结构化错误）
+func writeJSONStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	// 先按结构体标签序列化，需要时再统一转换字段名、去掉空值
+	if jsonNaming != "snake" || jsonOmitEmpty {
+		data, err := json.Marshal(v)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		var generic interface{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&generic); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		v = applyJSONPolicy(generic)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	// 调试模式下 ?pretty=true 输出缩进格式，方便用 curl 查看；默认仍为紧凑格式
+	if debugMode && r.URL.Query().Get("pretty") == "true" {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(v); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// 递归转换字段名；omitempty 只去掉 null、空字符串和空数组/对象，
+// 0 和 false 保留（如 "code":0 是前端判断成功的依据）
+func applyJSONPolicy(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for key, item := range val {
+			if jsonOmitEmpty && isEmptyJSONValue(item) {
+				continue
+			}
+			if jsonNaming == "camel" {
+				key = snakeToCamel(key)
+			}
+			out[key] = applyJSONPolicy(item)
+		}
+		return out
+	case []interface{}:
+		for i, item := range val {
+			val[i] = applyJSONPolicy(item)
+		}
+		return val
+	}
+	return v
+}
+
+func isEmptyJSONValue(v interface{}) bool {
+	switch val := v.(type) {
+	case nil:
+		return true
+	case string:
+		return val == ""
+	case []interface{}:
+		return len(val) == 0
+	case map[string]interface{}:
+		return len(val) == 0
+	}
+	return false
+}
+
+// snake_case 转 camelCase，如 window_minutes -> windowMinutes
+func snakeToCamel(key string) string {
+	parts := strings.Split(key, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// 去掉纯数字验证码中间的空格和分隔符（如 "123 456"、"123-456"），
+// 含字母的验证码保持原样，避免分隔符本身有意义时被误删
+func normalizeCode(code string) string {
+	// 用户照着短信里的显示格式输入时，去掉格式中不属于字符集的分隔符
+	for _, c := range codeDisplayMask {
+		if c != '#' && !strings.ContainsRune(codeCharset, c) {
+			code = strings.ReplaceAll(code, string(c), "")
+		}
+	}
+	stripped := codeSeparatorReplacer.Replace(code)
+	if digitsRegex.MatchString(stripped) {
+		return stripped
+	}
+	return code
+}
+
+// 规范化请求路径后再交给路由：合并重复斜杠，按配置处理末尾斜杠，
+// 含编码斜杠、点段或控制字符等明显异常的路径直接返回400
+func normalizePath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isMalformedPath(r.URL) {
+			http.Error(w, "Malformed request path", http.StatusBadRequest)
+			return
+		}
+
+		cleaned := path.Clean("/" + r.URL.Path)
+		if strictTrailingSlash && cleaned != "/" && strings.HasSuffix(r.URL.Path, "/") {
+			// 严格模式下 /api/search/ 和 /api/search 视为不同路径
+			cleaned += "/"
+		}
+		if cleaned != r.URL.Path {
+			r2 := new(http.Request)
+			*r2 = *r
+			u := *r.URL
+			u.Path = cleaned
+			u.RawPath = ""
+			r2.URL = &u
+			r = r2
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 读取客户端传入的关联 ID，格式不合法或没有传时生成一个；响应头原样带回，
+// 每个请求记一行日志，方便按关联 ID 串起客户端和服务端的记录
+func withCorrelationID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(correlationHeader)
+		if !correlationIDRegex.MatchString(id) {
+			id = newCorrelationID()
+		}
+		w.Header().Set(correlationHeader, id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		log.Printf("请求 %s %s 返回 %d，耗时 %s（关联 ID：%s）", r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Microsecond), id)
+	})
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 只记录状态码，不缓存响应体
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func tlsEnabled() bool {
+	return tlsCertFile != "" && tlsKeyFile != ""
+}
+
+// HTTPS 监听器上的响应加 HSTS 头
+func withHSTS(next http.Handler) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int64(hstsMaxAge/time.Second))
+	if hstsIncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 启用 HTTPS 后明文监听器只做重定向，用308保留请求方法和请求体
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(tlsAddr); err == nil && port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+func isMalformedPath(u *url.URL) bool {
+	escaped := strings.ToLower(u.EscapedPath())
+	if strings.Contains(escaped, "%2f") || strings.Contains(escaped, "%5c") {
+		return true
+	}
+	if !strings.HasPrefix(u.Path, "/") || strings.ContainsRune(u.Path, '\\') {
+		return true
+	}
+	for _, c := range u.Path {
+		if unicode.IsControl(c) {
+			return true
+		}
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// 按逗号拆分环境变量中的列表配置
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// 从环境变量读取配置
+func loadConfig() {
+	phoneBlacklist = splitList(os.Getenv("CAPTCHA_PHONE_BLACKLIST"))
+	phoneWhitelist = splitList(os.Getenv("CAPTCHA_PHONE_WHITELIST"))
+	whitelistOnly = os.Getenv("CAPTCHA_WHITELIST_ONLY") == "true"
+	if chars, ok := os.LookupEnv("CAPTCHA_PHONE_FORMAT_CHARS"); ok {
+		phoneFormatChars = chars
+	}
+	// 格式为 名称:令牌，多个用逗号分隔
+	for _, entry := range splitList(os.Getenv("CAPTCHA_ADMIN_TOKENS")) {
+		if name, token, ok := strings.Cut(entry, ":"); ok && token != "" {
+			adminTokens[token] = name
+		}
+	}
+	captchaMaxUses = envInt("CAPTCHA_MAX_USES", captchaMaxUses)
+	regenerateOnMaxAttempts = os.Getenv("CAPTCHA_REGENERATE_ON_MAX_ATTEMPTS") == "true"
+	configFile = os.Getenv("CAPTCHA_CONFIG_FILE")
+	rejectVoIP = os.Getenv("CAPTCHA_REJECT_VOIP") == "true"
+	// 格式同黑名单，如 170*,171*
+	voipPrefixes = splitList(os.Getenv("CAPTCHA_VOIP_PREFIXES"))
+	if len(voipPrefixes) > 0 {
+		numberLookup = prefixLookup(voipPrefixes)
+	}
+	if binding := os.Getenv("CAPTCHA_FINGERPRINT_BINDING"); binding != "" {
+		fingerprintBinding = binding
+	}
+	sendWindow = envDuration("CAPTCHA_SEND_WINDOW", sendWindow)
+	sendWindowLimit = envInt("CAPTCHA_SEND_WINDOW_LIMIT", sendWindowLimit)
+	sendHistoryMargin = envDuration("CAPTCHA_SEND_HISTORY_MARGIN", sendHistoryMargin)
+	lookupCacheTTL = envDuration("CAPTCHA_LOOKUP_CACHE_TTL", lookupCacheTTL)
+	idempotencyTTL = envDuration("CAPTCHA_IDEMPOTENCY_TTL", idempotencyTTL)
+	sendReservationTTL = envDuration("CAPTCHA_SEND_RESERVATION_TTL", sendReservationTTL)
+	outOfBandTTL = envDuration("CAPTCHA_OUT_OF_BAND_TTL", outOfBandTTL)
+	codeLength = envInt("CAPTCHA_CODE_LENGTH", codeLength)
+	minCodeLength = envInt("CAPTCHA_MIN_CODE_LENGTH", codeLength)
+	maxCodeLength = envInt("CAPTCHA_MAX_CODE_LENGTH", codeLength)
+	if charset := os.Getenv("CAPTCHA_CODE_CHARSET"); charset != "" {
+		codeCharset = charset
+	}
+	allowWeakCode = os.Getenv("CAPTCHA_ALLOW_WEAK_CODE") == "true"
+	codeDisplayMask = os.Getenv("CAPTCHA_CODE_DISPLAY_MASK")
+	verifyResponseFields = splitList(os.Getenv("CAPTCHA_VERIFY_RESPONSE_FIELDS"))
+	allowedOrigins = splitList(os.Getenv("CAPTCHA_ALLOWED_ORIGINS"))
+	corsMaxAge = envDuration("CAPTCHA_CORS_MAX_AGE", corsMaxAge)
+	corsMaxAgeEntries = splitList(os.Getenv("CAPTCHA_CORS_MAX_AGE_BY_ORIGIN"))
+	strictTrailingSlash = os.Getenv("CAPTCHA_STRICT_TRAILING_SLASH") == "true"
+	flushSuccessStatus = envInt("CAPTCHA_FLUSH_SUCCESS_STATUS", flushSuccessStatus)
+	if naming := os.Getenv("CAPTCHA_JSON_NAMING"); naming != "" {
+		jsonNaming = naming
+	}
+	jsonOmitEmpty = os.Getenv("CAPTCHA_JSON_OMIT_EMPTY") == "true"
+	statelessMode = os.Getenv("CAPTCHA_STATELESS") == "true"
+	tokenSecret = []byte(os.Getenv("CAPTCHA_TOKEN_SECRET"))
+	verifiedRetention = envDuration("CAPTCHA_VERIFIED_RETENTION", verifiedRetention)
+	reverifyGraceWindow = envDuration("CAPTCHA_REVERIFY_GRACE", reverifyGraceWindow)
+	alreadyVerifiedWindow = envDuration("CAPTCHA_ALREADY_VERIFIED_WINDOW", alreadyVerifiedWindow)
+	usedCodeRetention = envDuration("CAPTCHA_USED_CODE_RETENTION", usedCodeRetention)
+	statsWindowMinutes = envInt("CAPTCHA_STATS_WINDOW_MINUTES", statsWindowMinutes)
+	if addr := os.Getenv("CAPTCHA_HTTP_ADDR"); addr != "" {
+		httpAddr = addr
+	}
+	if addr := os.Getenv("CAPTCHA_TLS_ADDR"); addr != "" {
+		tlsAddr = addr
+	}
+	tlsCertFile = os.Getenv("CAPTCHA_TLS_CERT_FILE")
+	tlsKeyFile = os.Getenv("CAPTCHA_TLS_KEY_FILE")
+	adminClientCAFile = os.Getenv("CAPTCHA_ADMIN_CLIENT_CA_FILE")
+	adminRequireClientCert = os.Getenv("CAPTCHA_ADMIN_REQUIRE_CLIENT_CERT") == "true"
+	hstsMaxAge = envDuration("CAPTCHA_HSTS_MAX_AGE", hstsMaxAge)
+	hstsIncludeSubDomains = os.Getenv("CAPTCHA_HSTS_INCLUDE_SUBDOMAINS") == "true"
+	internalCIDRs = splitList(os.Getenv("CAPTCHA_INTERNAL_CIDRS"))
+	internalAPIKey = os.Getenv("CAPTCHA_INTERNAL_API_KEY")
+	if mode := os.Getenv("CAPTCHA_LOG_PHONE_MODE"); mode != "" {
+		logPhoneMode = mode
+	}
+	logPhoneSalt = []byte(os.Getenv("CAPTCHA_LOG_PHONE_SALT"))
+	debugMode = os.Getenv("CAPTCHA_DEBUG") == "true"
+	logCodes = os.Getenv("CAPTCHA_LOG_CODES") == "true"
+	logCodeSampleRate = envInt("CAPTCHA_LOG_CODES_SAMPLE_RATE", logCodeSampleRate)
+	quietHours = os.Getenv("CAPTCHA_QUIET_HOURS")
+	if tz := os.Getenv("CAPTCHA_QUIET_HOURS_TZ"); tz != "" {
+		quietHoursTZ = tz
+	}
+	if header := os.Getenv("CAPTCHA_CORRELATION_HEADER"); header != "" {
+		correlationHeader = http.CanonicalHeaderKey(header)
+	}
+	requireSecretAnswer = os.Getenv("CAPTCHA_REQUIRE_SECRET_ANSWER") == "true"
+	secureVerifyErrors = os.Getenv("CAPTCHA_SECURE_VERIFY_ERRORS") == "true"
+	secureVerifyMinDuration = envDuration("CAPTCHA_SECURE_VERIFY_MIN_DURATION", secureVerifyMinDuration)
+	if policy := os.Getenv("CAPTCHA_INVALID_UTF8"); policy != "" {
+		invalidUTF8Policy = policy
+	}
+	if env := os.Getenv("CAPTCHA_ENV"); env != "" {
+		appEnv = env
+	}
+	testPhones = splitList(os.Getenv("CAPTCHA_TEST_PHONES"))
+	testPhoneCode = os.Getenv("CAPTCHA_TEST_PHONE_CODE")
+	challengeDifficulty = envInt("CAPTCHA_CHALLENGE_DIFFICULTY", challengeDifficulty)
+	challengeTTL = envDuration("CAPTCHA_CHALLENGE_TTL", challengeTTL)
+}
+
+// 读取整数类型的环境变量，未设置或格式错误时使用默认值
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return n
+	}
+	return def
+}
+
+// 读取时长类型的环境变量（如 "24h"、"90s"），未设置或格式错误时使用默认值
+func envDuration(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return d
+	}
+	return def
+}
+
+// 读取并校验配置文件，未设置 CAPTCHA_CONFIG_FILE 时使用默认值
+func loadRuntimeConfig(filename string) (*runtimeConfig, error) {
+	cfg := defaultRuntimeConfig
+	cfg.SendWindow = sendWindow
+	cfg.SendWindowLimit = sendWindowLimit
+	if filename == "" {
+		return &cfg, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file runtimeConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", filename, err)
+	}
+	if file.CaptchaTTL != "" {
+		if cfg.CaptchaTTL, err = time.ParseDuration(file.CaptchaTTL); err != nil {
+			return nil, fmt.Errorf("captcha_ttl: %w", err)
+		}
+	}
+	if file.SendCooldown != "" {
+		if cfg.SendCooldown, err = time.ParseDuration(file.SendCooldown); err != nil {
+			return nil, fmt.Errorf("send_cooldown: %w", err)
+		}
+	}
+	if file.MaxVerifyAttempts != 0 {
+		cfg.MaxVerifyAttempts = file.MaxVerifyAttempts
+	}
+	if file.SendWindow != "" {
+		if cfg.SendWindow, err = time.ParseDuration(file.SendWindow); err != nil {
+			return nil, fmt.Errorf("send_window: %w", err)
+		}
+	}
+	// 0 表示不限制，需要和未填写区分开
+	if file.SendWindowLimit != nil {
+		cfg.SendWindowLimit = *file.SendWindowLimit
+	}
+	if file.ValidatePhoneLimit != 0 {
+		cfg.ValidatePhoneLimit = file.ValidatePhoneLimit
+	}
+
+	if cfg.CaptchaTTL <= 0 {
+		return nil, fmt.Errorf("captcha_ttl must be positive, got %s", cfg.CaptchaTTL)
+	}
+	if cfg.SendCooldown < 0 {
+		return nil, fmt.Errorf("send_cooldown must not be negative, got %s", cfg.SendCooldown)
+	}
+	if cfg.MaxVerifyAttempts < 1 {
+		return nil, fmt.Errorf("max_verify_attempts must be at least 1, got %d", cfg.MaxVerifyAttempts)
+	}
+	if cfg.SendWindowLimit > 0 && cfg.SendWindow <= 0 {
+		return nil, fmt.Errorf("send_window must be positive, got %s", cfg.SendWindow)
+	}
+	if cfg.ValidatePhoneLimit < 1 {
+		return nil, fmt.Errorf("validate_phone_limit must be at least 1, got %d", cfg.ValidatePhoneLimit)
+	}
+	return &cfg, nil
+}
+
+// 重新读取配置文件，校验失败时保留当前配置
+func reloadRuntimeConfig() error {
+	cfg, err := loadRuntimeConfig(configFile)
+	if err != nil {
+		return err
+	}
+	activeConfig.Store(cfg)
+	return nil
+}
+
+// 收到 SIGHUP 时热更新配置
+func watchConfigReload() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := reloadRuntimeConfig(); err != nil {
+			log.Printf("重新加载配置失败，继续使用当前配置：%v", err)
+			continue
+		}
+		cfg := currentConfig()
+		log.Printf("配置已重新加载：有效期 %s，冷却时间 %s，最多输错 %d 次，%s 内最多发送 %d 次，手机号校验每分钟最多 %d 次",
+			cfg.CaptchaTTL, cfg.SendCooldown, cfg.MaxVerifyAttempts, cfg.SendWindow, cfg.SendWindowLimit, cfg.ValidatePhoneLimit)
+	}
+}
+
+// 启动时校验配置，避免错误配置在运行中才暴露
+func validateConfig() error {
+	if fingerprintBinding != "off" && fingerprintBinding != "soft" && fingerprintBinding != "hard" {
+		return fmt.Errorf("CAPTCHA_FINGERPRINT_BINDING must be off, soft or hard, got %q", fingerprintBinding)
+	}
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return fmt.Errorf("CAPTCHA_TLS_CERT_FILE and CAPTCHA_TLS_KEY_FILE must be set together")
+	}
+	adminClientCAs = nil
+	if adminClientCAFile != "" {
+		if !tlsEnabled() {
+			return fmt.Errorf("CAPTCHA_ADMIN_CLIENT_CA_FILE requires CAPTCHA_TLS_CERT_FILE and CAPTCHA_TLS_KEY_FILE")
+		}
+		pem, err := os.ReadFile(adminClientCAFile)
+		if err != nil {
+			return fmt.Errorf("CAPTCHA_ADMIN_CLIENT_CA_FILE: %w", err)
+		}
+		adminClientCAs = x509.NewCertPool()
+		if !adminClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("CAPTCHA_ADMIN_CLIENT_CA_FILE %q contains no PEM certificates", adminClientCAFile)
+		}
+	}
+	if adminRequireClientCert && adminClientCAFile == "" {
+		return fmt.Errorf("CAPTCHA_ADMIN_REQUIRE_CLIENT_CERT requires CAPTCHA_ADMIN_CLIENT_CA_FILE")
+	}
+	if logPhoneMode != "mask" && logPhoneMode != "hash" {
+		return fmt.Errorf("CAPTCHA_LOG_PHONE_MODE must be mask or hash, got %q", logPhoneMode)
+	}
+	if logPhoneMode == "hash" && len(logPhoneSalt) < 16 {
+		return fmt.Errorf("CAPTCHA_LOG_PHONE_MODE=hash requires CAPTCHA_LOG_PHONE_SALT of at least 16 bytes")
+	}
+	if corsMaxAge < 0 {
+		return fmt.Errorf("CAPTCHA_CORS_MAX_AGE must not be negative, got %s", corsMaxAge)
+	}
+	corsMaxAgeByOrigin = make(map[string]time.Duration)
+	for _, entry := range corsMaxAgeEntries {
+		origin, value, ok := strings.Cut(entry, "=")
+		d, err := time.ParseDuration(value)
+		if !ok || origin == "" || err != nil || d < 0 {
+			return fmt.Errorf("CAPTCHA_CORS_MAX_AGE_BY_ORIGIN entry %q must look like https://example.com=1h", entry)
+		}
+		corsMaxAgeByOrigin[origin] = d
+	}
+	internalNets = nil
+	for _, cidr := range internalCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("CAPTCHA_INTERNAL_CIDRS: %w", err)
+		}
+		internalNets = append(internalNets, network)
+	}
+	if internalAPIKey != "" && len(internalAPIKey) < 32 {
+		return fmt.Errorf("CAPTCHA_INTERNAL_API_KEY must be at least 32 bytes")
+	}
+	if hstsMaxAge < 0 {
+		return fmt.Errorf("CAPTCHA_HSTS_MAX_AGE must not be negative, got %s", hstsMaxAge)
+	}
+	if outOfBandTTL <= 0 || outOfBandTTL > maxOutOfBandTTL {
+		return fmt.Errorf("CAPTCHA_OUT_OF_BAND_TTL must be positive and at most %s, got %s", maxOutOfBandTTL, outOfBandTTL)
+	}
+	if idempotencyTTL <= 0 {
+		return fmt.Errorf("CAPTCHA_IDEMPOTENCY_TTL must be positive, got %s", idempotencyTTL)
+	}
+	if sendReservationTTL <= 0 {
+		return fmt.Errorf("CAPTCHA_SEND_RESERVATION_TTL must be positive, got %s", sendReservationTTL)
+	}
+	if sendWindowLimit > 0 && sendWindow <= 0 {
+		return fmt.Errorf("CAPTCHA_SEND_WINDOW must be positive, got %s", sendWindow)
+	}
+	if sendHistoryMargin < 0 {
+		return fmt.Errorf("CAPTCHA_SEND_HISTORY_MARGIN must not be negative, got %s", sendHistoryMargin)
+	}
+	if statsWindowMinutes < 1 {
+		return fmt.Errorf("CAPTCHA_STATS_WINDOW_MINUTES must be at least 1, got %d", statsWindowMinutes)
+	}
+	if rejectVoIP && numberLookup == nil {
+		return fmt.Errorf("CAPTCHA_REJECT_VOIP requires a number lookup, set CAPTCHA_VOIP_PREFIXES")
+	}
+	if statelessMode && len(tokenSecret) < 32 {
+		return fmt.Errorf("CAPTCHA_STATELESS requires CAPTCHA_TOKEN_SECRET of at least 32 bytes")
+	}
+	// 令牌都是一次性的，不在服务端保留已用完的验证码，以下配置在无状态模式下无法生效
+	if statelessMode && (captchaMaxUses != 1 || reverifyGraceWindow > 0 || usedCodeRetention > 0) {
+		return fmt.Errorf("CAPTCHA_STATELESS cannot be combined with CAPTCHA_MAX_USES, CAPTCHA_REVERIFY_GRACE or CAPTCHA_USED_CODE_RETENTION")
+	}
+	// 无状态模式的验证码通过发送响应中的令牌下发，输错锁定后无法在验证请求中换发新令牌
+	if statelessMode && regenerateOnMaxAttempts {
+		return fmt.Errorf("CAPTCHA_STATELESS cannot be combined with CAPTCHA_REGENERATE_ON_MAX_ATTEMPTS")
+	}
+	if challengeDifficulty < 0 || challengeDifficulty > 32 {
+		return fmt.Errorf("CAPTCHA_CHALLENGE_DIFFICULTY must be between 0 and 32, got %d", challengeDifficulty)
+	}
+	if challengeDifficulty > 0 && len(tokenSecret) < 32 {
+		return fmt.Errorf("CAPTCHA_CHALLENGE_DIFFICULTY requires CAPTCHA_TOKEN_SECRET of at least 32 bytes")
+	}
+	if challengeDifficulty > 0 && challengeTTL <= 0 {
+		return fmt.Errorf("CAPTCHA_CHALLENGE_TTL must be positive, got %s", challengeTTL)
+	}
+	if invalidUTF8Policy != "reject" && invalidUTF8Policy != "sanitize" {
+		return fmt.Errorf("CAPTCHA_INVALID_UTF8 must be reject or sanitize, got %q", invalidUTF8Policy)
+	}
+	if len(testPhones) > 0 && appEnv == "production" {
+		return fmt.Errorf("CAPTCHA_TEST_PHONES must not be set when CAPTCHA_ENV is production")
+	}
+	if logCodes && appEnv == "production" {
+		return fmt.Errorf("CAPTCHA_LOG_CODES must not be enabled when CAPTCHA_ENV is production")
+	}
+	if logCodeSampleRate < 1 {
+		return fmt.Errorf("CAPTCHA_LOG_CODES_SAMPLE_RATE must be at least 1, got %d", logCodeSampleRate)
+	}
+	if testPhoneCode != "" && len(testPhones) == 0 {
+		return fmt.Errorf("CAPTCHA_TEST_PHONE_CODE requires CAPTCHA_TEST_PHONES")
+	}
+	for _, c := range testPhoneCode {
+		if !strings.ContainsRune(codeCharset, c) {
+			return fmt.Errorf("CAPTCHA_TEST_PHONE_CODE %q contains characters outside the charset %q", testPhoneCode, codeCharset)
+		}
+	}
+	if strings.ContainsAny(phoneFormatChars, "+0123456789") {
+		return fmt.Errorf("CAPTCHA_PHONE_FORMAT_CHARS must not contain digits or '+', got %q", phoneFormatChars)
+	}
+	if flushSuccessStatus != http.StatusNoContent && flushSuccessStatus != http.StatusOK {
+		return fmt.Errorf("CAPTCHA_FLUSH_SUCCESS_STATUS must be 204 or 200, got %d", flushSuccessStatus)
+	}
+	if jsonNaming != "snake" && jsonNaming != "camel" {
+		return fmt.Errorf("CAPTCHA_JSON_NAMING must be snake or camel, got %q", jsonNaming)
+	}
+	if reverifyGraceWindow > verifiedRetention {
+		return fmt.Errorf("CAPTCHA_REVERIFY_GRACE (%s) must not exceed CAPTCHA_VERIFIED_RETENTION (%s)", reverifyGraceWindow, verifiedRetention)
+	}
+	if quietHours != "" {
+		start, end, ok := strings.Cut(quietHours, "-")
+		var errStart, errEnd error
+		quietStart, errStart = parseClock(start)
+		quietEnd, errEnd = parseClock(end)
+		if !ok || errStart != nil || errEnd != nil || quietStart == quietEnd {
+			return fmt.Errorf("CAPTCHA_QUIET_HOURS must look like 22:00-08:00, got %q", quietHours)
+		}
+		loc, err := time.LoadLocation(quietHoursTZ)
+		if err != nil {
+			return fmt.Errorf("CAPTCHA_QUIET_HOURS_TZ: %w", err)
+		}
+		quietLocation = loc
+	}
+	if secureVerifyMinDuration < 0 {
+		return fmt.Errorf("CAPTCHA_SECURE_VERIFY_MIN_DURATION must not be negative, got %s", secureVerifyMinDuration)
+	}
+	if requireSecretAnswer && reverifyGraceWindow > 0 {
+		return fmt.Errorf("CAPTCHA_REVERIFY_GRACE lets phones re-verify without checking the code, so it cannot be combined with CAPTCHA_REQUIRE_SECRET_ANSWER")
+	}
+	if usedCodeRetention < 0 {
+		return fmt.Errorf("CAPTCHA_USED_CODE_RETENTION must not be negative, got %s", usedCodeRetention)
+	}
+	if alreadyVerifiedWindow > verifiedRetention {
+		return fmt.Errorf("CAPTCHA_ALREADY_VERIFIED_WINDOW (%s) must not exceed CAPTCHA_VERIFIED_RETENTION (%s)", alreadyVerifiedWindow, verifiedRetention)
+	}
+	if captchaMaxUses < 1 {
+		return fmt.Errorf("CAPTCHA_MAX_USES must be at least 1, got %d", captchaMaxUses)
+	}
+	if codeLength < 1 || utf8.RuneCountInString(codeCharset) < 2 {
+		return fmt.Errorf("captcha code needs a positive length and at least 2 characters in the charset")
+	}
+	// 不受 CAPTCHA_ALLOW_WEAK_CODE 影响：长度为0时不指定长度的请求会生成空验证码
+	if minCodeLength < 1 {
+		return fmt.Errorf("CAPTCHA_MIN_CODE_LENGTH must be at least 1, got %d", minCodeLength)
+	}
+	if minCodeLength > codeLength || maxCodeLength < codeLength {
+		return fmt.Errorf("captcha length range %d-%d must include the default length %d", minCodeLength, maxCodeLength, codeLength)
+	}
+	if codeDisplayMask != "" && strings.Count(codeDisplayMask, "#") != codeLength {
+		return fmt.Errorf("CAPTCHA_CODE_DISPLAY_MASK %q must contain %d '#' placeholders", codeDisplayMask, codeLength)
+	}
+	for _, field := range verifyResponseFields {
+		switch field {
+		case "expire_at", "phone":
+		case "token":
+			// 令牌用 CAPTCHA_TOKEN_SECRET 签名，只有无状态模式要求配置密钥
+			if !statelessMode {
+				return fmt.Errorf("verify response field token requires CAPTCHA_STATELESS=true")
+			}
+		default:
+			return fmt.Errorf("unknown verify response field %q", field)
+		}
+	}
+	// 按允许的最短长度计算，请求覆盖长度时也不会低于门槛
+	if bits := codeEntropyBits(minCodeLength); bits < minCodeEntropyBits && !allowWeakCode {
+		return fmt.Errorf("captcha code entropy %.1f bits (length %d, charset %q) is below the minimum %.1f bits; "+
+			"use a longer code or larger charset, or set CAPTCHA_ALLOW_WEAK_CODE=true for test environments",
+			bits, minCodeLength, codeCharset, minCodeEntropyBits)
+	}
+	return nil
+}
+
+func main() {
+	loadConfig()
+	if err := validateConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := reloadRuntimeConfig(); err != nil {
+		log.Fatalf("Invalid configuration file: %v", err)
+	}
+	go watchConfigReload()
+	verifyStats = newRateStats(statsWindowMinutes)
+	go runJanitor(time.Minute)
+	http.HandleFunc("/api/send-captcha", allowMethods(sendCaptchaHandler, http.MethodPost))
+	http.HandleFunc("/api/verify-captcha", allowMethods(verifyCaptchaHandler, http.MethodPost))
+	http.HandleFunc("/api/validate-phone", allowMethods(validatePhoneHandler, http.MethodPost))
+	http.HandleFunc("/api/challenge", allowMethods(challengeHandler, http.MethodGet))
+	http.HandleFunc("/api/captcha-config", allowMethods(captchaConfigHandler, http.MethodGet))
+	http.HandleFunc("/api/verify-captcha-batch", allowMethods(verifyCaptchaBatchHandler, http.MethodPost))
+	http.HandleFunc("/api/admin/stats", allowMethods(statsHandler, http.MethodGet))
+	http.HandleFunc("/api/admin/preissue", allowMethods(preissueCaptchaHandler, http.MethodPost, http.MethodDelete))
+	http.HandleFunc("/api/admin/secret-answer", allowMethods(secretAnswerHandler, http.MethodPut, http.MethodDelete))
+	http.HandleFunc("/api/admin/flush", allowMethods(flushHandler, http.MethodPost))
+	http.HandleFunc("/api/admin/verified", allowMethods(verifiedHandler, http.MethodGet, http.MethodDelete))
+	handler := withCorrelationID(normalizePath(http.DefaultServeMux))
+	if !tlsEnabled() {
+		log.Printf("Server starting on %s...", httpAddr)
+		if err := http.ListenAndServe(httpAddr, handler); err != nil {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+		return
+	}
+	go func() {
+		if err := http.ListenAndServe(httpAddr, http.HandlerFunc(redirectToHTTPS)); err != nil {
+			log.Fatalf("HTTP redirect listener failed to start: %v", err)
+		}
+	}()
+	log.Printf("Server starting on %s (HTTPS), redirecting %s...", tlsAddr, httpAddr)
+	server := &http.Server{Addr: tlsAddr, Handler: withHSTS(handler)}
+	if adminClientCAs != nil {
+		// 普通接口的客户端不带证书，握手时只请求证书，是否有效由 authenticateClientCert 判断
+		server.TLSConfig = &tls.Config{ClientAuth: tls.RequestClientCert}
+	}
+	if err := server.ListenAndServeTLS(tlsCertFile, tlsKeyFile); err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+}
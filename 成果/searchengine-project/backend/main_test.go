@@ -0,0 +1,2574 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loadConfig 以全局变量的当前值作为未设置环境变量时的默认值，所以每个测试开始前
+// 先恢复为进程启动时的值，避免上一个测试的配置带到下一个测试；loadConfig 新增配置时要加到这里
+var configDefaults = []func(){
+	keep(&adminClientCAFile),
+	keep(&adminRequireClientCert),
+	keep(&allowWeakCode),
+	keep(&allowedOrigins),
+	keep(&alreadyVerifiedWindow),
+	keep(&appEnv),
+	keep(&captchaMaxUses),
+	keep(&challengeDifficulty),
+	keep(&challengeTTL),
+	keep(&codeCharset),
+	keep(&codeDisplayMask),
+	keep(&codeLength),
+	keep(&configFile),
+	keep(&correlationHeader),
+	keep(&corsMaxAge),
+	keep(&corsMaxAgeEntries),
+	keep(&debugMode),
+	keep(&fingerprintBinding),
+	keep(&flushSuccessStatus),
+	keep(&hstsIncludeSubDomains),
+	keep(&hstsMaxAge),
+	keep(&httpAddr),
+	keep(&idempotencyTTL),
+	keep(&internalAPIKey),
+	keep(&internalCIDRs),
+	keep(&invalidUTF8Policy),
+	keep(&jsonNaming),
+	keep(&jsonOmitEmpty),
+	keep(&logCodeSampleRate),
+	keep(&logCodes),
+	keep(&logPhoneMode),
+	keep(&logPhoneSalt),
+	keep(&lookupCacheTTL),
+	keep(&maxCodeLength),
+	keep(&minCodeLength),
+	keep(&outOfBandTTL),
+	keep(&phoneBlacklist),
+	keep(&phoneFormatChars),
+	keep(&phoneWhitelist),
+	keep(&quietHours),
+	keep(&quietHoursTZ),
+	keep(&regenerateOnMaxAttempts),
+	keep(&rejectVoIP),
+	keep(&requireSecretAnswer),
+	keep(&reverifyGraceWindow),
+	keep(&secureVerifyErrors),
+	keep(&secureVerifyMinDuration),
+	keep(&sendHistoryMargin),
+	keep(&sendReservationTTL),
+	keep(&sendWindow),
+	keep(&sendWindowLimit),
+	keep(&statelessMode),
+	keep(&statsWindowMinutes),
+	keep(&strictTrailingSlash),
+	keep(&testPhoneCode),
+	keep(&testPhones),
+	keep(&tlsAddr),
+	keep(&tlsCertFile),
+	keep(&tlsKeyFile),
+	keep(&tokenSecret),
+	keep(&usedCodeRetention),
+	keep(&verifiedRetention),
+	keep(&verifyResponseFields),
+	keep(&voipPrefixes),
+	keep(&whitelistOnly),
+	keep(&codeRandom),
+	keep(&numberLookup),
+}
+
+func keep[T any](p *T) func() {
+	v := *p
+	return func() { *p = v }
+}
+
+// 每个测试从空存储和默认配置开始：清除外部的 CAPTCHA_* 环境变量，按传入的 KEY=VALUE 设置后
+// 重新加载并校验配置。环境变量由 t.Setenv 在测试结束后恢复
+func setupTest(t *testing.T, env ...string) {
+	t.Helper()
+	if err := loadTestConfig(t, env...); err != nil {
+		t.Fatalf("invalid test configuration: %v", err)
+	}
+}
+
+// 同 setupTest，但返回配置校验的结果，用于测试启动校验本身
+func loadTestConfig(t *testing.T, env ...string) error {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		if key, _, _ := strings.Cut(kv, "="); strings.HasPrefix(key, "CAPTCHA_") {
+			t.Setenv(key, "")
+			os.Unsetenv(key)
+		}
+	}
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		t.Setenv(key, value)
+	}
+
+	for _, restore := range configDefaults {
+		restore()
+	}
+	clear(adminTokens)
+	logCodeCounter.Store(0)
+
+	mu.Lock()
+	clear(captchaStore)
+	mu.Unlock()
+	clear(lastVerified)
+	noncesMu.Lock()
+	clear(statelessNonces)
+	flushedAt = time.Time{}
+	clear(spentChallenges)
+	noncesMu.Unlock()
+	clear(sendHistory)
+	clear(idempotentSends)
+	clear(lookupCache)
+	clear(lastCodes)
+	clear(secretAnswers)
+	clear(verifyFailures)
+	validatePhoneLimiter = newIPRateLimiter(time.Minute)
+
+	loadConfig()
+	if err := validateConfig(); err != nil {
+		return err
+	}
+	if err := reloadRuntimeConfig(); err != nil {
+		return err
+	}
+	verifyStats = newRateStats(statsWindowMinutes)
+	return nil
+}
+
+// 调用处理函数并返回响应，body 为空时不带请求体
+func doRequest(h http.HandlerFunc, method, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/", strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func sendCaptcha(phone string, headers ...string) *httptest.ResponseRecorder {
+	return doRequest(sendCaptchaHandler, http.MethodPost, `{"phone":"`+phone+`"}`, headers...)
+}
+
+func verify(phone, code string, headers ...string) *httptest.ResponseRecorder {
+	return doRequest(verifyCaptchaHandler, http.MethodPost, `{"phone":"`+phone+`","code":"`+code+`"}`, headers...)
+}
+
+// 取出手机号当前待验证的验证码，不存在时测试失败
+func storedCode(t *testing.T, phone string) string {
+	t.Helper()
+	mu.RLock()
+	info, ok := captchaStore[phone]
+	mu.RUnlock()
+	if !ok {
+		t.Fatalf("no captcha stored for %s", phone)
+	}
+	return info.Code
+}
+
+// 解析 JSON 响应体
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var resp map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v (%q)", err, w.Body.String())
+	}
+	return resp
+}
+
+// 把日志输出到内存中，测试结束后恢复
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestSendCaptchaRejectsBlacklistedPrefix(t *testing.T) {
+	setupTest(t, "CAPTCHA_PHONE_BLACKLIST=170*,13900139000")
+
+	for _, phone := range []string{"17012345678", "13900139000"} {
+		if w := sendCaptcha(phone); w.Code != http.StatusForbidden {
+			t.Errorf("send to %s: status %d, want 403", phone, w.Code)
+		}
+	}
+	if w := sendCaptcha("13800138000"); w.Code != http.StatusOK {
+		t.Errorf("send to unlisted number: status %d, want 200", w.Code)
+	}
+}
+
+func TestSendCaptchaWhitelistOnly(t *testing.T) {
+	setupTest(t, "CAPTCHA_WHITELIST_ONLY=true", "CAPTCHA_PHONE_WHITELIST=13800138000,186*")
+
+	if w := sendCaptcha("13900139000"); w.Code != http.StatusForbidden {
+		t.Errorf("send to unlisted number: status %d, want 403", w.Code)
+	}
+	mu.RLock()
+	_, stored := captchaStore["13900139000"]
+	mu.RUnlock()
+	if stored {
+		t.Error("a code was generated for a blocked number")
+	}
+	for _, phone := range []string{"13800138000", "18612345678"} {
+		if w := sendCaptcha(phone); w.Code != http.StatusOK {
+			t.Errorf("send to %s: status %d, want 200", phone, w.Code)
+		}
+	}
+}
+
+func TestVerifyAcceptsSpacedNumericCode(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+	sendCaptcha(phone)
+	code := storedCode(t, phone)
+
+	if w := verify(phone, " "+code[:3]+" "+code[3:]+" "); w.Code != http.StatusOK {
+		t.Fatalf("verify spaced code: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestNormalizeCode(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		in, want string
+	}{
+		{"123 456", "123456"},
+		{"123-456", "123456"},
+		{"12.34\t56", "123456"},
+		{"ab-12", "ab-12"}, // 含字母的验证码不去掉分隔符
+		{"A1 B2", "A1 B2"},
+	}
+	for _, tt := range tests {
+		if got := normalizeCode(tt.in); got != tt.want {
+			t.Errorf("normalizeCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// 把验证码的发送时间往前推，模拟发送冷却期已经过去
+func backdateSend(phone string, d time.Duration) {
+	mu.Lock()
+	info := captchaStore[phone]
+	info.SentAt = info.SentAt.Add(-d)
+	captchaStore[phone] = info
+	mu.Unlock()
+}
+
+// 输错直到达到次数上限，返回最后一次的响应
+func exhaustAttempts(phone, code string) *httptest.ResponseRecorder {
+	var w *httptest.ResponseRecorder
+	for i := 0; i < currentConfig().MaxVerifyAttempts; i++ {
+		w = verify(phone, code)
+	}
+	return w
+}
+
+// 生成一个与 code 不同的同长度验证码
+func wrongCode(code string) string {
+	if code[0] == '0' {
+		return "1" + code[1:]
+	}
+	return "0" + code[1:]
+}
+
+func TestVerifyLocksOutAfterMaxAttempts(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+	sendCaptcha(phone)
+	code := storedCode(t, phone)
+
+	w := exhaustAttempts(phone, wrongCode(code))
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "please request a new captcha") {
+		t.Fatalf("last wrong attempt: status %d (%s)", w.Code, w.Body.String())
+	}
+	if w := verify(phone, code); w.Code != http.StatusBadRequest {
+		t.Errorf("correct code after lockout: status %d, want 400", w.Code)
+	}
+}
+
+func TestVerifyRegeneratesAfterMaxAttempts(t *testing.T) {
+	setupTest(t, "CAPTCHA_REGENERATE_ON_MAX_ATTEMPTS=true")
+	phone := "13800138000"
+	sendCaptcha(phone)
+	backdateSend(phone, 2*time.Minute)
+	old := storedCode(t, phone)
+
+	w := exhaustAttempts(phone, wrongCode(old))
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "a new captcha has been sent") {
+		t.Fatalf("last wrong attempt: status %d (%s)", w.Code, w.Body.String())
+	}
+	mu.RLock()
+	info, ok := captchaStore[phone]
+	mu.RUnlock()
+	if !ok || info.Attempts != 0 || info.Code == old {
+		t.Fatalf("no fresh captcha after regeneration: %+v", info)
+	}
+	if w := verify(phone, info.Code); w.Code != http.StatusOK {
+		t.Errorf("verify regenerated code: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestVerifyDoesNotRegenerateDuringCooldown(t *testing.T) {
+	setupTest(t, "CAPTCHA_REGENERATE_ON_MAX_ATTEMPTS=true")
+	phone := "13800138000"
+	sendCaptcha(phone)
+
+	w := exhaustAttempts(phone, wrongCode(storedCode(t, phone)))
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "please request a new captcha") {
+		t.Fatalf("last wrong attempt: status %d (%s)", w.Code, w.Body.String())
+	}
+	mu.RLock()
+	_, ok := captchaStore[phone]
+	mu.RUnlock()
+	if ok {
+		t.Error("a new captcha was issued inside the send cooldown")
+	}
+}
+
+func TestConcurrentSendsIssueOneCode(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+
+	codes := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- sendCaptcha(phone).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	sent := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			sent++
+		}
+	}
+	if sent != 1 {
+		t.Errorf("%d of %d concurrent sends succeeded, want 1", sent, cap(codes))
+	}
+}
+
+// 写入一个尚未下发完成的预留，sentAt 为预留时间
+func reserveSend(phone string, sentAt time.Time) {
+	mu.Lock()
+	captchaStore[phone] = CaptchaInfo{
+		Code:     "123456",
+		SentAt:   sentAt,
+		ExpireAt: sentAt.Add(currentConfig().CaptchaTTL),
+		MaxUses:  1,
+		Length:   6,
+		Pending:  true,
+	}
+	mu.Unlock()
+}
+
+func TestSendRetryDuringPendingReservation(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+	reserveSend(phone, time.Now())
+
+	if w := sendCaptcha(phone); w.Code != http.StatusConflict {
+		t.Fatalf("retry during reservation: status %d, want 409", w.Code)
+	}
+	if code := storedCode(t, phone); code != "123456" {
+		t.Errorf("reservation was replaced by %q", code)
+	}
+}
+
+func TestTrustedSendRetryDuringPendingReservation(t *testing.T) {
+	// httptest 请求的对端地址为 192.0.2.1；内部调用方不受冷却期限制，但同样不能在下发过程中生成第二个验证码
+	setupTest(t, "CAPTCHA_INTERNAL_CIDRS=192.0.2.0/24")
+	phone := "13800138000"
+	reserveSend(phone, time.Now())
+
+	if w := sendCaptcha(phone); w.Code != http.StatusConflict {
+		t.Fatalf("trusted retry during reservation: status %d, want 409", w.Code)
+	}
+}
+
+func TestSendAfterStaleReservation(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+	reserveSend(phone, time.Now().Add(-sendReservationTTL-time.Second))
+
+	if w := sendCaptcha(phone); w.Code != http.StatusOK {
+		t.Fatalf("send after stale reservation: status %d (%s)", w.Code, w.Body.String())
+	}
+	mu.RLock()
+	info := captchaStore[phone]
+	mu.RUnlock()
+	if info.Pending || info.Code == "123456" {
+		t.Errorf("stale reservation was not replaced by a delivered code: %+v", info)
+	}
+}
+
+func TestSendConfirmsReservationAfterDelivery(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+	if w := sendCaptcha(phone); w.Code != http.StatusOK {
+		t.Fatalf("send: status %d", w.Code)
+	}
+	mu.RLock()
+	info := captchaStore[phone]
+	mu.RUnlock()
+	if info.Pending {
+		t.Error("captcha still pending after delivery")
+	}
+	// 下发完成后重试按冷却期处理
+	if w := sendCaptcha(phone); w.Code != http.StatusTooManyRequests {
+		t.Errorf("retry after delivery: status %d, want 429", w.Code)
+	}
+}
+
+func TestBatchVerifyMixedResults(t *testing.T) {
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=alice:secret-token")
+	sendCaptcha("13800138000")
+	sendCaptcha("13800138001")
+	good := storedCode(t, "13800138000")
+	other := storedCode(t, "13800138001")
+
+	body := `{"items":[
+		{"phone":"13800138000","code":"` + good + `"},
+		{"phone":"13800138001","code":"` + wrongCode(other) + `"},
+		{"phone":"13800138002","code":"123456"},
+		{"phone":"not-a-phone","code":"123456"}
+	]}`
+	w := doRequest(verifyCaptchaBatchHandler, http.MethodPost, body, "Authorization", "Bearer secret-token")
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch verify: status %d (%s)", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Results []BatchVerifyResult `json:"results"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	want := []bool{true, false, false, false}
+	if len(resp.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(resp.Results), len(want))
+	}
+	for i, ok := range want {
+		if resp.Results[i].Success != ok {
+			t.Errorf("item %d: success %v, want %v (%s)", i, resp.Results[i].Success, ok, resp.Results[i].Msg)
+		}
+	}
+	// 无效号码原样返回输入
+	if got := resp.Results[3].Phone; got != "not-a-phone" {
+		t.Errorf("invalid item phone %q, want the raw input", got)
+	}
+
+	// 与单个验证共用逻辑：成功的验证码已被消费，输错的计入次数
+	mu.RLock()
+	_, consumed := captchaStore["13800138000"]
+	attempts := captchaStore["13800138001"].Attempts
+	mu.RUnlock()
+	if consumed || attempts != 1 {
+		t.Errorf("consumed=%v attempts=%d after batch, want consumed and 1 attempt", !consumed, attempts)
+	}
+}
+
+func TestBatchVerifyRequiresAdmin(t *testing.T) {
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=alice:secret-token")
+	body := `{"items":[{"phone":"13800138000","code":"123456"}]}`
+
+	for _, auth := range []string{"", "Bearer wrong-token", "secret-token"} {
+		if w := doRequest(verifyCaptchaBatchHandler, http.MethodPost, body, "Authorization", auth); w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d, want 401", auth, w.Code)
+		}
+	}
+}
+
+func TestMultiUseCode(t *testing.T) {
+	setupTest(t, "CAPTCHA_MAX_USES=2")
+	phone := "13800138000"
+	sendCaptcha(phone)
+	code := storedCode(t, phone)
+
+	for i := 1; i <= 2; i++ {
+		if w := verify(phone, code); w.Code != http.StatusOK {
+			t.Fatalf("use %d: status %d (%s)", i, w.Code, w.Body.String())
+		}
+	}
+	if w := verify(phone, code); w.Code == http.StatusOK {
+		t.Error("third use of a 2-use code succeeded")
+	}
+}
+
+func TestSingleUseCodeByDefault(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+	sendCaptcha(phone)
+	code := storedCode(t, phone)
+
+	if w := verify(phone, code); w.Code != http.StatusOK {
+		t.Fatalf("first use: status %d", w.Code)
+	}
+	if w := verify(phone, code); w.Code == http.StatusOK {
+		t.Error("second use of a single-use code succeeded")
+	}
+}
+
+func TestValidateConfigRejectsWeakCode(t *testing.T) {
+	err := loadTestConfig(t, "CAPTCHA_CODE_LENGTH=2")
+	if err == nil || !strings.Contains(err.Error(), "entropy") {
+		t.Fatalf("2-digit numeric code: err = %v, want an entropy error", err)
+	}
+}
+
+func TestValidateConfigAcceptsStrongCode(t *testing.T) {
+	for _, env := range [][]string{
+		nil, // 默认6位数字
+		{"CAPTCHA_CODE_LENGTH=8"},
+		{"CAPTCHA_CODE_LENGTH=4", "CAPTCHA_CODE_CHARSET=ABCDEFGHJKLMNPQRSTUVWXYZ23456789"},
+	} {
+		if err := loadTestConfig(t, env...); err != nil {
+			t.Errorf("%v: %v", env, err)
+		}
+	}
+}
+
+func TestValidateConfigAllowWeakCodeOverride(t *testing.T) {
+	if err := loadTestConfig(t, "CAPTCHA_CODE_LENGTH=2", "CAPTCHA_ALLOW_WEAK_CODE=true"); err != nil {
+		t.Fatalf("weak code with override: %v", err)
+	}
+}
+
+func TestVerifyResponseDefaultPayload(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+	sendCaptcha(phone)
+
+	w := verify(phone, storedCode(t, phone))
+	resp := decodeResponse(t, w)
+	if len(resp) != 2 || resp["code"] != 0.0 || resp["msg"] != "Captcha verified successfully" {
+		t.Errorf("default payload = %v, want only code and msg", resp)
+	}
+}
+
+func TestVerifyResponseSelectedFields(t *testing.T) {
+	setupTest(t, "CAPTCHA_VERIFY_RESPONSE_FIELDS=expire_at,phone")
+	phone := "13800138000"
+	sendCaptcha(phone)
+
+	resp := decodeResponse(t, verify(phone, storedCode(t, phone)))
+	if resp["phone"] != "138****8000" {
+		t.Errorf("phone = %v, want the masked number", resp["phone"])
+	}
+	if _, ok := resp["expire_at"].(string); !ok {
+		t.Errorf("expire_at missing from %v", resp)
+	}
+}
+
+func TestValidateConfigRejectsUnknownResponseField(t *testing.T) {
+	if err := loadTestConfig(t, "CAPTCHA_VERIFY_RESPONSE_FIELDS=user"); err == nil {
+		t.Error("unknown verify response field accepted")
+	}
+	// 令牌用无状态模式的密钥签名
+	if err := loadTestConfig(t, "CAPTCHA_VERIFY_RESPONSE_FIELDS=token"); err == nil {
+		t.Error("token field accepted outside stateless mode")
+	}
+}
+
+// 经过路径规范化后交给路由，返回响应和路由看到的路径
+func routePath(rawPath string) (*httptest.ResponseRecorder, string) {
+	var seen string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/send-captcha", func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.Path
+	})
+	// 与真实请求一样按请求行解析，不做点段和斜杠的处理
+	r := httptest.NewRequest(http.MethodPost, rawPath, nil)
+	w := httptest.NewRecorder()
+	normalizePath(mux).ServeHTTP(w, r)
+	return w, seen
+}
+
+func TestNormalizePathCollapsesSlashes(t *testing.T) {
+	setupTest(t)
+	for _, p := range []string{"/api/send-captcha", "//api//send-captcha", "/api/send-captcha/"} {
+		w, seen := routePath(p)
+		if w.Code != http.StatusOK || seen != "/api/send-captcha" {
+			t.Errorf("%s: status %d, routed as %q", p, w.Code, seen)
+		}
+	}
+}
+
+func TestNormalizePathStrictTrailingSlash(t *testing.T) {
+	setupTest(t, "CAPTCHA_STRICT_TRAILING_SLASH=true")
+	if w, seen := routePath("/api/send-captcha/"); w.Code != http.StatusNotFound || seen != "" {
+		t.Errorf("trailing slash in strict mode: status %d, routed as %q", w.Code, seen)
+	}
+	if w, seen := routePath("//api/send-captcha"); w.Code != http.StatusOK || seen != "/api/send-captcha" {
+		t.Errorf("duplicate slash in strict mode: status %d, routed as %q", w.Code, seen)
+	}
+}
+
+func TestNormalizePathRejectsMalformed(t *testing.T) {
+	setupTest(t)
+	for _, p := range []string{
+		"/api%2fsend-captcha",
+		"/api/%5csend-captcha",
+		"/api/../api/send-captcha",
+		"/api/./send-captcha",
+		"/api/send-captcha%00",
+	} {
+		if w, seen := routePath(p); w.Code != http.StatusBadRequest || seen != "" {
+			t.Errorf("%s: status %d, routed as %q, want 400", p, w.Code, seen)
+		}
+	}
+}
+
+func TestAllowHeaderPerRoute(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		want    string
+	}{
+		{allowMethods(sendCaptchaHandler, http.MethodPost), http.MethodGet, "POST, OPTIONS"},
+		{allowMethods(challengeHandler, http.MethodGet), http.MethodPost, "GET, OPTIONS"},
+		{allowMethods(secretAnswerHandler, http.MethodPut, http.MethodDelete), http.MethodPost, "PUT, DELETE, OPTIONS"},
+		{allowMethods(verifiedHandler, http.MethodGet, http.MethodDelete), http.MethodPatch, "GET, DELETE, OPTIONS"},
+	}
+	for _, tt := range tests {
+		w := doRequest(tt.handler, tt.method, "")
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != tt.want {
+			t.Errorf("%s: status %d, Allow %q, want 405 with %q", tt.method, w.Code, w.Header().Get("Allow"), tt.want)
+		}
+	}
+}
+
+func TestOptionsReturnsAllow(t *testing.T) {
+	setupTest(t)
+	w := doRequest(allowMethods(sendCaptchaHandler, http.MethodPost), http.MethodOptions, "")
+	if w.Code != http.StatusOK || w.Header().Get("Allow") != "POST, OPTIONS" {
+		t.Errorf("OPTIONS: status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func sendWithLength(phone string, length int) *httptest.ResponseRecorder {
+	return doRequest(sendCaptchaHandler, http.MethodPost, `{"phone":"`+phone+`","length":`+strconv.Itoa(length)+`}`)
+}
+
+func TestSendWithOverriddenLength(t *testing.T) {
+	setupTest(t, "CAPTCHA_MIN_CODE_LENGTH=6", "CAPTCHA_MAX_CODE_LENGTH=8")
+	phone := "13800138000"
+	if w := sendWithLength(phone, 8); w.Code != http.StatusOK {
+		t.Fatalf("send: status %d", w.Code)
+	}
+	code := storedCode(t, phone)
+	if len(code) != 8 {
+		t.Fatalf("code %q, want 8 digits", code)
+	}
+
+	// 按发送时记录的长度校验，6位输入在全局范围内但与该验证码的长度不符
+	if w := verify(phone, code[:6]); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "8 digits") {
+		t.Errorf("6-digit input: status %d (%s)", w.Code, w.Body.String())
+	}
+	if w := verify(phone, code); w.Code != http.StatusOK {
+		t.Errorf("8-digit code: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestSendWithOutOfRangeLengthUsesDefault(t *testing.T) {
+	setupTest(t, "CAPTCHA_MIN_CODE_LENGTH=6", "CAPTCHA_MAX_CODE_LENGTH=8")
+	for i, length := range []int{0, 4, 12} {
+		phone := "1380013800" + strconv.Itoa(i)
+		sendWithLength(phone, length)
+		if code := storedCode(t, phone); len(code) != codeLength {
+			t.Errorf("length %d: code %q, want the default %d digits", length, code, codeLength)
+		}
+	}
+}
+
+// 请求可指定的最短长度同样要满足熵门槛
+func TestValidateConfigRejectsWeakMinLength(t *testing.T) {
+	if err := loadTestConfig(t, "CAPTCHA_MIN_CODE_LENGTH=4"); err == nil {
+		t.Error("minimum length 4 accepted")
+	}
+}
+
+func TestValidateConfigRejectsZeroMinLength(t *testing.T) {
+	err := loadTestConfig(t, "CAPTCHA_MIN_CODE_LENGTH=0", "CAPTCHA_ALLOW_WEAK_CODE=true")
+	if err == nil || !strings.Contains(err.Error(), "CAPTCHA_MIN_CODE_LENGTH") {
+		t.Errorf("minimum length 0: err = %v", err)
+	}
+}
+
+func TestStatsSuccessRate(t *testing.T) {
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=ops:stats-token")
+	phones := []string{"13800138000", "13800138001", "13800138002", "13800138003"}
+	for _, phone := range phones {
+		sendCaptcha(phone)
+	}
+	verify(phones[0], storedCode(t, phones[0]))
+	verify(phones[1], wrongCode(storedCode(t, phones[1])))
+
+	w := doRequest(statsHandler, http.MethodGet, "", "Authorization", "Bearer stats-token")
+	resp := decodeResponse(t, w)
+	if resp["sent"] != 4.0 || resp["verified"] != 1.0 || resp["success_rate"] != 0.25 {
+		t.Errorf("stats = %v, want 4 sent, 1 verified, rate 0.25", resp)
+	}
+	if w := doRequest(statsHandler, http.MethodGet, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("stats without token: status %d, want 401", w.Code)
+	}
+}
+
+func TestRateStatsWindowIsBounded(t *testing.T) {
+	stats := newRateStats(3)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		stats.record(start.Add(time.Duration(i)*time.Minute), 1, 1)
+	}
+	if len(stats.buckets) != 3 {
+		t.Fatalf("%d buckets, want 3", len(stats.buckets))
+	}
+	// 只统计最近3分钟
+	if sent, verified := stats.totals(start.Add(9 * time.Minute)); sent != 3 || verified != 3 {
+		t.Errorf("totals = %d/%d, want 3/3", sent, verified)
+	}
+}
+
+func TestLastVerifiedLookup(t *testing.T) {
+	setupTest(t, "CAPTCHA_VERIFIED_RETENTION=1h")
+	phone := "13800138000"
+	if _, ok := lastVerifiedAt(phone, time.Now()); ok {
+		t.Fatal("phone that never verified has a timestamp")
+	}
+	sendCaptcha(phone)
+	before := time.Now()
+	verify(phone, storedCode(t, phone))
+
+	at, ok := lastVerifiedAt(phone, time.Now())
+	if !ok || at.Before(before) || at.After(time.Now()) {
+		t.Fatalf("lastVerifiedAt = %v, %v", at, ok)
+	}
+	// 超过保留期视为不存在，清理任务随后删除
+	later := at.Add(time.Hour)
+	if _, ok := lastVerifiedAt(phone, later); ok {
+		t.Error("timestamp still returned after the retention period")
+	}
+	pruneLastVerified(later)
+	if _, ok := lastVerifiedAt(phone, at); ok {
+		t.Error("expired record not pruned")
+	}
+}
+
+func TestVerifiedAdminLookupAndDelete(t *testing.T) {
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=ops:admin-token")
+	phone := "13800138000"
+	sendCaptcha(phone)
+	verify(phone, storedCode(t, phone))
+	auth := []string{"Authorization", "Bearer admin-token"}
+
+	lookup := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/admin/verified?phone="+phone, nil)
+		r.Header.Set(auth[0], auth[1])
+		w := httptest.NewRecorder()
+		verifiedHandler(w, r)
+		return w
+	}
+	w := lookup()
+	if resp := decodeResponse(t, w); w.Code != http.StatusOK || resp["verified_at"] == nil {
+		t.Fatalf("lookup: status %d (%s)", w.Code, w.Body.String())
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/admin/verified?phone="+phone, nil)
+	r.Header.Set(auth[0], auth[1])
+	verifiedHandler(httptest.NewRecorder(), r)
+	if w := lookup(); w.Code != http.StatusNotFound {
+		t.Errorf("lookup after delete: status %d, want 404", w.Code)
+	}
+}
+
+func TestReverifyWithinGraceWindow(t *testing.T) {
+	setupTest(t, "CAPTCHA_REVERIFY_GRACE=1m")
+	phone := "13800138000"
+	sendCaptcha(phone)
+	if w := verify(phone, storedCode(t, phone)); w.Code != http.StatusOK {
+		t.Fatalf("first verify: status %d", w.Code)
+	}
+
+	// 前端丢失结果后重试，不需要验证码
+	if w := verify(phone, ""); w.Code != http.StatusOK {
+		t.Errorf("re-verify within grace: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestReverifyAfterGraceWindow(t *testing.T) {
+	setupTest(t, "CAPTCHA_REVERIFY_GRACE=1m")
+	phone := "13800138000"
+	sendCaptcha(phone)
+	verify(phone, storedCode(t, phone))
+
+	if !withinReverifyGrace(phone, "", time.Now()) {
+		t.Fatal("not within grace right after verifying")
+	}
+	if withinReverifyGrace(phone, "", time.Now().Add(time.Minute+time.Second)) {
+		t.Error("still within grace after the window")
+	}
+}
+
+func TestReverifyGraceRequiresSameDeviceUnderHardBinding(t *testing.T) {
+	setupTest(t, "CAPTCHA_REVERIFY_GRACE=1m", "CAPTCHA_FINGERPRINT_BINDING=hard")
+	phone := "13800138000"
+	sendCaptcha(phone, "User-Agent", "app/1.0")
+	if w := verify(phone, storedCode(t, phone), "User-Agent", "app/1.0"); w.Code != http.StatusOK {
+		t.Fatalf("first verify: status %d", w.Code)
+	}
+
+	if w := verify(phone, "", "User-Agent", "other-device/2.0"); w.Code == http.StatusOK {
+		t.Error("grace window accepted a different device under hard binding")
+	}
+	if w := verify(phone, "", "User-Agent", "app/1.0"); w.Code != http.StatusOK {
+		t.Errorf("re-verify from the same device: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestReverifyGraceIgnoredWithPendingCode(t *testing.T) {
+	setupTest(t, "CAPTCHA_REVERIFY_GRACE=1m")
+	phone := "13800138000"
+	sendCaptcha(phone)
+	verify(phone, storedCode(t, phone))
+
+	// 又申请了新的验证码，必须按新验证码校验
+	mu.Lock()
+	issueCaptchaLocked(phone, currentConfig(), time.Now(), codeLength, "")
+	mu.Unlock()
+	if w := verify(phone, ""); w.Code == http.StatusOK {
+		t.Error("grace window bypassed a pending code")
+	}
+}
+
+func TestValidateConfigGraceWithinRetention(t *testing.T) {
+	if err := loadTestConfig(t, "CAPTCHA_REVERIFY_GRACE=2h", "CAPTCHA_VERIFIED_RETENTION=1h"); err == nil {
+		t.Error("grace window longer than the retention accepted")
+	}
+}
+
+func TestJSONNamingPolicies(t *testing.T) {
+	body := map[string]interface{}{
+		"code":           0,
+		"window_minutes": 60,
+		"results":        []interface{}{map[string]interface{}{"expire_at": "x"}},
+		"msg":            "",
+	}
+	tests := []struct {
+		env  []string
+		want string
+	}{
+		{nil, `{"code":0,"msg":"","results":[{"expire_at":"x"}],"window_minutes":60}`},
+		{[]string{"CAPTCHA_JSON_NAMING=camel"}, `{"code":0,"msg":"","results":[{"expireAt":"x"}],"windowMinutes":60}`},
+		{[]string{"CAPTCHA_JSON_OMIT_EMPTY=true"}, `{"code":0,"results":[{"expire_at":"x"}],"window_minutes":60}`},
+	}
+	for _, tt := range tests {
+		setupTest(t, tt.env...)
+		w := httptest.NewRecorder()
+		writeJSON(w, httptest.NewRequest(http.MethodGet, "/", nil), body)
+		if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestValidateConfigRejectsUnknownNaming(t *testing.T) {
+	if err := loadTestConfig(t, "CAPTCHA_JSON_NAMING=kebab"); err == nil {
+		t.Error("unknown naming policy accepted")
+	}
+}
+
+const testTokenSecret = "CAPTCHA_TOKEN_SECRET=0123456789abcdef0123456789abcdef"
+
+// 无状态模式下发送验证码，返回令牌和验证码。服务端不保存验证码，所以固定随机源
+func sendStateless(t *testing.T, phone string) (token, code string) {
+	t.Helper()
+	codeRandom = bytes.NewReader([]byte{1, 2, 3, 4, 5, 6})
+	w := sendCaptcha(phone)
+	codeRandom = rand.Reader
+	if w.Code != http.StatusOK {
+		t.Fatalf("stateless send: status %d (%s)", w.Code, w.Body.String())
+	}
+	token, _ = decodeResponse(t, w)["token"].(string)
+	return token, "123456"
+}
+
+func verifyStateless(phone, code, token string) *httptest.ResponseRecorder {
+	return doRequest(verifyCaptchaHandler, http.MethodPost, `{"phone":"`+phone+`","code":"`+code+`","token":"`+token+`"}`)
+}
+
+func TestStatelessVerify(t *testing.T) {
+	setupTest(t, "CAPTCHA_STATELESS=true", testTokenSecret)
+	phone := "13800138000"
+	token, code := sendStateless(t, phone)
+	mu.RLock()
+	stored := len(captchaStore)
+	mu.RUnlock()
+	if token == "" || stored != 0 {
+		t.Fatalf("token %q, %d entries in captchaStore", token, stored)
+	}
+
+	if w := verifyStateless(phone, wrongCode(code), token); w.Code != http.StatusBadRequest {
+		t.Errorf("wrong code: status %d, want 400", w.Code)
+	}
+	if w := verifyStateless(phone, code, token); w.Code != http.StatusOK {
+		t.Fatalf("stateless verify: status %d (%s)", w.Code, w.Body.String())
+	}
+	// 令牌编号已使用，重放失败
+	if w := verifyStateless(phone, code, token); w.Code == http.StatusOK {
+		t.Error("replayed token accepted")
+	}
+}
+
+func TestStatelessRejectsTamperedToken(t *testing.T) {
+	setupTest(t, "CAPTCHA_STATELESS=true", testTokenSecret)
+	phone, other := "13800138000", "13900139000"
+	token, code := sendStateless(t, phone)
+	payload, sig, _ := strings.Cut(token, ".")
+
+	// 把令牌中的手机号改成另一个号码，签名保持不变
+	data, _ := base64.RawURLEncoding.DecodeString(payload)
+	forged := base64.RawURLEncoding.EncodeToString(bytes.Replace(data, []byte(phone), []byte(other), 1))
+	tests := []struct {
+		phone, token string
+	}{
+		{other, forged + "." + sig},
+		{phone, payload + "." + base64.RawURLEncoding.EncodeToString(make([]byte, 32))},
+		{phone, payload},
+		{other, token}, // 令牌属于另一个号码
+	}
+	for _, tt := range tests {
+		w := verifyStateless(tt.phone, code, tt.token)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid captcha token") {
+			t.Errorf("token %q for %s: status %d (%s)", tt.token, tt.phone, w.Code, w.Body.String())
+		}
+	}
+	// 篡改的令牌都没有消耗原令牌
+	if w := verifyStateless(phone, code, token); w.Code != http.StatusOK {
+		t.Errorf("original token: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestStatelessSendCooldown(t *testing.T) {
+	for _, env := range [][]string{
+		{"CAPTCHA_STATELESS=true", testTokenSecret},
+		{"CAPTCHA_STATELESS=true", testTokenSecret, "CAPTCHA_SEND_WINDOW_LIMIT=0"},
+	} {
+		setupTest(t, env...)
+		phone := "13800138000"
+		sendStateless(t, phone)
+		w := sendCaptcha(phone)
+		if w.Code != http.StatusTooManyRequests || decodeResponse(t, w)["limit"] != "cooldown" {
+			t.Errorf("%v: second send: status %d (%s), want a cooldown 429", env, w.Code, w.Body.String())
+		}
+
+		// 冷却期过后可以再次发送
+		sendHistoryMu.Lock()
+		history := sendHistory[phone]
+		history[len(history)-1] = history[len(history)-1].Add(-2 * time.Minute)
+		sendHistoryMu.Unlock()
+		if w := sendCaptcha(phone); w.Code != http.StatusOK {
+			t.Errorf("%v: send after cooldown: status %d", env, w.Code)
+		}
+	}
+}
+
+func TestValidateConfigRejectsStatelessWithServerSideReuse(t *testing.T) {
+	for _, extra := range []string{
+		"CAPTCHA_MAX_USES=2",
+		"CAPTCHA_REVERIFY_GRACE=1m",
+		"CAPTCHA_USED_CODE_RETENTION=1m",
+		"CAPTCHA_REGENERATE_ON_MAX_ATTEMPTS=true",
+	} {
+		if err := loadTestConfig(t, "CAPTCHA_STATELESS=true", testTokenSecret, extra); err == nil {
+			t.Errorf("stateless mode with %s accepted", extra)
+		}
+	}
+	if err := loadTestConfig(t, "CAPTCHA_STATELESS=true", "CAPTCHA_TOKEN_SECRET=short"); err == nil {
+		t.Error("short token secret accepted")
+	}
+}
+
+func TestFlushInvalidatesAllCaptchas(t *testing.T) {
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=ops:admin-token")
+	phones := []string{"13800138000", "13800138001"}
+	codes := make([]string, len(phones))
+	for i, phone := range phones {
+		sendCaptcha(phone)
+		codes[i] = storedCode(t, phone)
+	}
+	if w := doRequest(flushHandler, http.MethodPost, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("flush without token: status %d, want 401", w.Code)
+	}
+
+	logs := captureLog(t)
+	if w := doRequest(flushHandler, http.MethodPost, "", "Authorization", "Bearer admin-token"); w.Code/100 != 2 {
+		t.Fatalf("flush: status %d", w.Code)
+	}
+	if !strings.Contains(logs.String(), "管理员 ops 作废了全部验证码，共 2 个") {
+		t.Errorf("flush not audited with the admin identity: %s", logs.String())
+	}
+	for i, phone := range phones {
+		if w := verify(phone, codes[i]); w.Code == http.StatusOK {
+			t.Errorf("code for %s still verifies after flush", phone)
+		}
+	}
+}
+
+func TestFlushClearsReverifyGraceAndIdempotentSends(t *testing.T) {
+	path := t.TempDir() + "/captcha.json"
+	writeConfigFile(t, path, `{"send_cooldown":"0s"}`)
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=ops:admin-token", "CAPTCHA_REVERIFY_GRACE=1m", "CAPTCHA_CONFIG_FILE="+path)
+	phone := "13800138000"
+	first := sendCaptcha(phone, "Idempotency-Key", "retry-1")
+	code := storedCode(t, phone)
+	if w := verify(phone, code); w.Code != http.StatusOK {
+		t.Fatalf("verify: status %d", w.Code)
+	}
+
+	if w := doRequest(flushHandler, http.MethodPost, "", "Authorization", "Bearer admin-token"); w.Code/100 != 2 {
+		t.Fatalf("flush: status %d", w.Code)
+	}
+	if w := verify(phone, ""); w.Code == http.StatusOK {
+		t.Error("grace window survived the flush")
+	}
+	if w := verify(phone, wrongCode(code)); w.Code == http.StatusOK {
+		t.Error("wrong code accepted after the flush")
+	}
+	again := sendCaptcha(phone, "Idempotency-Key", "retry-1")
+	if again.Header().Get("Idempotent-Replayed") != "" || again.Body.String() == first.Body.String() {
+		t.Errorf("idempotent send replayed after the flush: %d %s", again.Code, again.Body.String())
+	}
+}
+
+func TestVerifyResponseIncludesToken(t *testing.T) {
+	setupTest(t, "CAPTCHA_STATELESS=true", testTokenSecret, "CAPTCHA_VERIFY_RESPONSE_FIELDS=token")
+	phone := "13800138000"
+	token, code := sendStateless(t, phone)
+
+	resp := decodeResponse(t, verifyStateless(phone, code, token))
+	verified, _ := resp["token"].(string)
+	var claims verifiedClaims
+	if err := parseToken(verified, &claims); err != nil || claims.Type != "verified" || claims.Phone != phone {
+		t.Fatalf("verified token %q: claims %+v, err %v", verified, claims, err)
+	}
+	if time.Unix(claims.ExpireAt, 0).Before(time.Now()) {
+		t.Errorf("verified token already expired: %+v", claims)
+	}
+	// 不能冒充验证码令牌再验证一次
+	if w := verifyStateless(phone, code, verified); w.Code == http.StatusOK {
+		t.Error("verified token accepted as a captcha token")
+	}
+}
+
+func TestFlushInvalidatesStatelessTokens(t *testing.T) {
+	setupTest(t, "CAPTCHA_STATELESS=true", testTokenSecret, "CAPTCHA_ADMIN_TOKENS=ops:admin-token")
+	phone := "13800138000"
+	token, code := sendStateless(t, phone)
+
+	doRequest(flushHandler, http.MethodPost, "", "Authorization", "Bearer admin-token")
+	if w := verifyStateless(phone, code, token); w.Code == http.StatusOK {
+		t.Error("token issued before the flush still verifies")
+	}
+}
+
+func TestOriginlessRequestPassesAllowlist(t *testing.T) {
+	setupTest(t, "CAPTCHA_ALLOWED_ORIGINS=https://app.example.com")
+	h := allowMethods(sendCaptchaHandler, http.MethodPost)
+
+	w := doRequest(h, http.MethodPost, `{"phone":"13800138000"}`)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("originless send: status %d, ACAO %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+	// 同一地址带 Origin 的响应不同，缓存必须按 Origin 区分
+	if w.Header().Get("Vary") != "Origin" {
+		t.Errorf("originless send: Vary %q, want Origin", w.Header().Get("Vary"))
+	}
+	// 不受 CORS 约束，但冷却期照常生效
+	if w := doRequest(h, http.MethodPost, `{"phone":"13800138000"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("originless resend: status %d, want 429", w.Code)
+	}
+}
+
+func TestDisallowedOriginBlocked(t *testing.T) {
+	setupTest(t, "CAPTCHA_ALLOWED_ORIGINS=https://app.example.com")
+	h := allowMethods(sendCaptchaHandler, http.MethodPost)
+
+	w := doRequest(h, http.MethodPost, `{"phone":"13800138000"}`, "Origin", "https://evil.example.com")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("disallowed origin: status %d, want 403", w.Code)
+	}
+	mu.RLock()
+	n := len(captchaStore)
+	mu.RUnlock()
+	if n != 0 {
+		t.Error("captcha sent for a disallowed origin")
+	}
+
+	w = doRequest(h, http.MethodPost, `{"phone":"13800138000"}`, "Origin", "https://app.example.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("allowed origin: status %d, ACAO %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestPreflightOnlyForCORSRequests(t *testing.T) {
+	setupTest(t, "CAPTCHA_ALLOWED_ORIGINS=https://app.example.com")
+	h := allowMethods(sendCaptchaHandler, http.MethodPost)
+
+	w := doRequest(h, http.MethodOptions, "", "Origin", "https://app.example.com", "Access-Control-Request-Method", "POST")
+	if w.Header().Get("Access-Control-Allow-Methods") != "POST, OPTIONS" {
+		t.Errorf("preflight: Allow-Methods %q", w.Header().Get("Access-Control-Allow-Methods"))
+	}
+	// 没有 Access-Control-Request-Method 的 OPTIONS 不是预检
+	w = doRequest(h, http.MethodOptions, "", "Origin", "https://app.example.com")
+	if w.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Error("preflight headers sent for a plain OPTIONS request")
+	}
+	w = doRequest(h, http.MethodOptions, "")
+	if w.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Error("preflight headers sent for a request without Origin")
+	}
+}
+
+func TestDisplayMaskFormatsDeliveredCode(t *testing.T) {
+	setupTest(t, "CAPTCHA_CODE_DISPLAY_MASK=###-###", "CAPTCHA_ENV=development", "CAPTCHA_LOG_CODES=true")
+	logs := captureLog(t)
+	phone := "13800138000"
+	sendCaptcha(phone)
+
+	code := storedCode(t, phone)
+	if !digitsRegex.MatchString(code) {
+		t.Errorf("stored code %q, want the raw digits", code)
+	}
+	if !strings.Contains(logs.String(), "验证码："+code[:3]+"-"+code[3:]) {
+		t.Errorf("delivered code not formatted: %s", logs.String())
+	}
+}
+
+func TestDisplayMaskVerifyAcceptsRawAndFormatted(t *testing.T) {
+	for _, formatted := range []bool{false, true} {
+		setupTest(t, "CAPTCHA_CODE_DISPLAY_MASK=###-###")
+		phone := "13800138000"
+		sendCaptcha(phone)
+		input := storedCode(t, phone)
+		if formatted {
+			input = input[:3] + "-" + input[3:]
+		}
+		if w := verify(phone, input); w.Code != http.StatusOK {
+			t.Errorf("verify %q: status %d (%s)", input, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestFormatCodeForDisplay(t *testing.T) {
+	setupTest(t, "CAPTCHA_CODE_DISPLAY_MASK=## ## ##")
+	if got := formatCodeForDisplay("123456"); got != "12 34 56" {
+		t.Errorf("formatCodeForDisplay = %q", got)
+	}
+	// 请求指定了其他长度时原样返回
+	if got := formatCodeForDisplay("12345678"); got != "12345678" {
+		t.Errorf("formatCodeForDisplay(8 digits) = %q", got)
+	}
+	if err := loadTestConfig(t, "CAPTCHA_CODE_DISPLAY_MASK=###-##"); err == nil {
+		t.Error("mask with the wrong number of placeholders accepted")
+	}
+}
+
+func writeConfigFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadChangesCooldown(t *testing.T) {
+	path := t.TempDir() + "/captcha.json"
+	writeConfigFile(t, path, `{"send_cooldown":"1h"}`)
+	setupTest(t, "CAPTCHA_CONFIG_FILE="+path)
+	phone := "13800138000"
+	sendCaptcha(phone)
+	if w := sendCaptcha(phone); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("resend under 1h cooldown: status %d, want 429", w.Code)
+	}
+
+	writeConfigFile(t, path, `{"send_cooldown":"0s"}`)
+	if err := reloadRuntimeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if w := sendCaptcha(phone); w.Code != http.StatusOK {
+		t.Errorf("resend after reloading a 0s cooldown: status %d", w.Code)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	path := t.TempDir() + "/captcha.json"
+	writeConfigFile(t, path, `{"captcha_ttl":"10m","max_verify_attempts":3}`)
+	setupTest(t, "CAPTCHA_CONFIG_FILE="+path)
+
+	for _, bad := range []string{`{"captcha_ttl":"-1m"}`, `{"max_verify_attempts":-1}`, `{"send_cooldown":"soon"}`, `{"send_window":"0s"}`, `{"validate_phone_limit":-1}`, `not json`} {
+		writeConfigFile(t, path, bad)
+		if err := reloadRuntimeConfig(); err == nil {
+			t.Errorf("%s: reload succeeded", bad)
+		}
+	}
+	if cfg := currentConfig(); cfg.CaptchaTTL != 10*time.Minute || cfg.MaxVerifyAttempts != 3 {
+		t.Errorf("active config changed by a bad reload: %+v", cfg)
+	}
+}
+
+func TestReloadSendWindowAndValidatePhoneLimit(t *testing.T) {
+	path := t.TempDir() + "/captcha.json"
+	writeConfigFile(t, path, `{"send_cooldown":"0s","send_window":"1h","send_window_limit":1,"validate_phone_limit":1}`)
+	setupTest(t, "CAPTCHA_CONFIG_FILE="+path)
+	phone := "13800138000"
+	sendCaptcha(phone)
+	if w := sendCaptcha(phone); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second send with a window limit of 1: status %d, want 429", w.Code)
+	}
+	validate := func() int {
+		return doRequest(validatePhoneHandler, http.MethodPost, `{"phone":"13800138000"}`).Code
+	}
+	validate()
+	if code := validate(); code != http.StatusTooManyRequests {
+		t.Fatalf("second validation with a limit of 1: status %d, want 429", code)
+	}
+
+	// 窗口次数为0表示不限制，不能被当成未填写
+	writeConfigFile(t, path, `{"send_cooldown":"0s","send_window_limit":0,"validate_phone_limit":5}`)
+	if err := reloadRuntimeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if w := sendCaptcha(phone); w.Code != http.StatusOK {
+		t.Errorf("send after lifting the window limit: status %d", w.Code)
+	}
+	if code := validate(); code != http.StatusOK {
+		t.Errorf("validation after raising the limit: status %d", code)
+	}
+}
+
+func TestFlushReturnsNoContent(t *testing.T) {
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=ops:admin-token")
+	sendCaptcha("13800138000")
+
+	h := allowMethods(flushHandler, http.MethodPost)
+	w := doRequest(h, http.MethodPost, "", "Authorization", "Bearer admin-token", "Origin", "https://admin.example.com")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Fatalf("flush: status %d, body %q, want 204 with no body", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("CORS headers missing from the 204 response: %v", w.Header())
+	}
+}
+
+func TestFlushJSONResponse(t *testing.T) {
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=ops:admin-token", "CAPTCHA_FLUSH_SUCCESS_STATUS=200")
+	sendCaptcha("13800138000")
+
+	w := doRequest(flushHandler, http.MethodPost, "", "Authorization", "Bearer admin-token")
+	if resp := decodeResponse(t, w); w.Code != http.StatusOK || resp["flushed"] != 1.0 {
+		t.Errorf("flush: status %d (%s)", w.Code, w.Body.String())
+	}
+	if err := loadTestConfig(t, "CAPTCHA_FLUSH_SUCCESS_STATUS=202"); err == nil {
+		t.Error("unsupported flush status accepted")
+	}
+}
+
+func TestFixedRandomSourceYieldsKnownCode(t *testing.T) {
+	setupTest(t)
+	codeRandom = bytes.NewReader([]byte{1, 2, 3, 4, 5, 6})
+
+	phone := "13800138000"
+	if w := sendCaptcha(phone); w.Code != http.StatusOK {
+		t.Fatalf("send: status %d (%s)", w.Code, w.Body.String())
+	}
+	if code := storedCode(t, phone); code != "123456" {
+		t.Errorf("generated code %q, want 123456", code)
+	}
+	if _, err := generateCode(6); err == nil {
+		t.Error("generateCode succeeded with an exhausted random source")
+	}
+}
+
+// 按号码返回固定结果的号码查询，记录调用次数
+type mockLookup struct {
+	types map[string]LineType
+	calls int
+}
+
+func (m *mockLookup) Lookup(phone string) (NumberInfo, error) {
+	m.calls++
+	if lt, ok := m.types[phone]; ok {
+		return NumberInfo{LineType: lt}, nil
+	}
+	return NumberInfo{LineType: LineTypeMobile}, nil
+}
+
+func TestSendRejectsVoIPFromLookup(t *testing.T) {
+	setupTest(t)
+	lookup := &mockLookup{types: map[string]LineType{"13800138000": LineTypeVoIP}}
+	numberLookup = lookup
+	rejectVoIP = true
+
+	for i := 0; i < 2; i++ {
+		if w := sendCaptcha("13800138000"); w.Code != http.StatusForbidden {
+			t.Errorf("send to VoIP number: status %d, want 403", w.Code)
+		}
+	}
+	if lookup.calls != 1 {
+		t.Errorf("lookup called %d times, want 1 (second result from cache)", lookup.calls)
+	}
+	if w := sendCaptcha("13900139000"); w.Code != http.StatusOK {
+		t.Errorf("send to mobile number: status %d (%s)", w.Code, w.Body.String())
+	}
+
+	rejectVoIP = false
+	if w := sendCaptcha("13800138000"); w.Code != http.StatusOK {
+		t.Errorf("send to VoIP number with rejection off: status %d", w.Code)
+	}
+}
+
+func TestVoIPPrefixLookup(t *testing.T) {
+	setupTest(t, "CAPTCHA_REJECT_VOIP=true", "CAPTCHA_VOIP_PREFIXES=170*,171*")
+
+	if w := sendCaptcha("17012345678"); w.Code != http.StatusForbidden {
+		t.Errorf("send to 170 number: status %d, want 403", w.Code)
+	}
+	if w := sendCaptcha("13800138000"); w.Code != http.StatusOK {
+		t.Errorf("send to mobile number: status %d (%s)", w.Code, w.Body.String())
+	}
+	if err := loadTestConfig(t, "CAPTCHA_REJECT_VOIP=true"); err == nil {
+		t.Error("CAPTCHA_REJECT_VOIP accepted without a number lookup")
+	}
+}
+
+func TestRegenerateCountsTowardsSendWindow(t *testing.T) {
+	setupTest(t, "CAPTCHA_REGENERATE_ON_MAX_ATTEMPTS=true", "CAPTCHA_SEND_WINDOW_LIMIT=2", "CAPTCHA_SEND_WINDOW=1h")
+	phone := "13800138000"
+	sendCaptcha(phone)
+
+	// 第一次重发用掉窗口内的第二次发送
+	backdateSend(phone, 2*time.Minute)
+	if w := exhaustAttempts(phone, wrongCode(storedCode(t, phone))); !strings.Contains(w.Body.String(), "a new captcha has been sent") {
+		t.Fatalf("first lockout: status %d (%s)", w.Code, w.Body.String())
+	}
+	sendHistoryMu.Lock()
+	sent := len(sendHistory[phone])
+	sendHistoryMu.Unlock()
+	if sent != 2 {
+		t.Errorf("send history has %d entries, want 2 (regeneration counted)", sent)
+	}
+
+	// 窗口内已达上限，不再重发，按普通锁定处理
+	backdateSend(phone, 2*time.Minute)
+	if w := exhaustAttempts(phone, wrongCode(storedCode(t, phone))); !strings.Contains(w.Body.String(), "please request a new captcha") {
+		t.Fatalf("second lockout: status %d (%s)", w.Code, w.Body.String())
+	}
+	mu.RLock()
+	_, ok := captchaStore[phone]
+	mu.RUnlock()
+	if ok {
+		t.Error("a new captcha was issued beyond the send window limit")
+	}
+}
+
+func TestRegenerateSkipsBlockedNumber(t *testing.T) {
+	setupTest(t, "CAPTCHA_REGENERATE_ON_MAX_ATTEMPTS=true")
+	phone := "13800138000"
+	sendCaptcha(phone)
+	backdateSend(phone, 2*time.Minute)
+	phoneBlacklist = []string{phone}
+
+	if w := exhaustAttempts(phone, wrongCode(storedCode(t, phone))); !strings.Contains(w.Body.String(), "please request a new captcha") {
+		t.Fatalf("lockout of a blacklisted number: status %d (%s)", w.Code, w.Body.String())
+	}
+	mu.RLock()
+	_, ok := captchaStore[phone]
+	mu.RUnlock()
+	if ok {
+		t.Error("a new captcha was issued to a blacklisted number")
+	}
+}
+
+func TestSendWindowBlocksOutsideCooldown(t *testing.T) {
+	setupTest(t, "CAPTCHA_SEND_WINDOW_LIMIT=3", "CAPTCHA_SEND_WINDOW=1h")
+	phone := "13800138000"
+
+	for i := 0; i < 3; i++ {
+		if w := sendCaptcha(phone); w.Code != http.StatusOK {
+			t.Fatalf("send %d: status %d (%s)", i+1, w.Code, w.Body.String())
+		}
+		backdateSend(phone, 2*time.Minute)
+	}
+	if w := sendCaptcha(phone); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("fourth send: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestValidatePhone(t *testing.T) {
+	setupTest(t)
+
+	w := doRequest(validatePhoneHandler, http.MethodPost, `{"phone":"13800138000"}`)
+	if resp := decodeResponse(t, w); w.Code != http.StatusOK || resp["valid"] != true || resp["e164"] != "+8613800138000" {
+		t.Errorf("valid number: status %d (%s)", w.Code, w.Body.String())
+	}
+	w = doRequest(validatePhoneHandler, http.MethodPost, `{"phone":"12345"}`)
+	if resp := decodeResponse(t, w); w.Code != http.StatusOK || resp["valid"] != false || resp["e164"] != nil {
+		t.Errorf("invalid number: status %d (%s)", w.Code, w.Body.String())
+	}
+	mu.RLock()
+	stored := len(captchaStore)
+	mu.RUnlock()
+	if stored != 0 {
+		t.Errorf("validation stored %d captchas", stored)
+	}
+}
+
+func TestValidatePhoneRateLimited(t *testing.T) {
+	setupTest(t)
+
+	for i := 0; i < 30; i++ {
+		if w := doRequest(validatePhoneHandler, http.MethodPost, `{"phone":"13800138000"}`); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, w.Code)
+		}
+	}
+	if w := doRequest(validatePhoneHandler, http.MethodPost, `{"phone":"13800138000"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("31st request: status %d, want 429", w.Code)
+	}
+}
+
+func TestFingerprintBinding(t *testing.T) {
+	tests := []struct {
+		binding  string
+		verifyUA string
+		want     int
+	}{
+		{"hard", "app/1.0", http.StatusOK},
+		{"hard", "other-device/2.0", http.StatusBadRequest},
+		{"soft", "other-device/2.0", http.StatusOK},
+		{"off", "other-device/2.0", http.StatusOK},
+	}
+	for _, tt := range tests {
+		setupTest(t, "CAPTCHA_FINGERPRINT_BINDING="+tt.binding)
+		phone := "13800138000"
+		sendCaptcha(phone, "User-Agent", "app/1.0")
+		if w := verify(phone, storedCode(t, phone), "User-Agent", tt.verifyUA); w.Code != tt.want {
+			t.Errorf("%s binding, verify from %q: status %d, want %d (%s)", tt.binding, tt.verifyUA, w.Code, tt.want, w.Body.String())
+		}
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	setupTest(t, "CAPTCHA_TLS_ADDR=:8443")
+	r := httptest.NewRequest(http.MethodPost, "http://captcha.example.com:8080/api/send-captcha?x=1", nil)
+	w := httptest.NewRecorder()
+	redirectToHTTPS(w, r)
+
+	if w.Code != http.StatusPermanentRedirect {
+		t.Errorf("redirect status %d, want 308", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "https://captcha.example.com:8443/api/send-captcha?x=1" {
+		t.Errorf("Location %q", loc)
+	}
+	if w.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("plain HTTP response carries an HSTS header")
+	}
+}
+
+func TestHSTSHeader(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	for _, tt := range []struct {
+		env  []string
+		want string
+	}{
+		{[]string{"CAPTCHA_HSTS_MAX_AGE=1h"}, "max-age=3600"},
+		{[]string{"CAPTCHA_HSTS_MAX_AGE=1h", "CAPTCHA_HSTS_INCLUDE_SUBDOMAINS=true"}, "max-age=3600; includeSubDomains"},
+	} {
+		setupTest(t, tt.env...)
+		w := httptest.NewRecorder()
+		withHSTS(http.HandlerFunc(ok)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := w.Header().Get("Strict-Transport-Security"); got != tt.want {
+			t.Errorf("%v: HSTS %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestSendReturnsLoggedReference(t *testing.T) {
+	setupTest(t)
+	logs := captureLog(t)
+
+	w := sendCaptcha("13800138000")
+	ref, _ := decodeResponse(t, w)["reference"].(string)
+	if !strings.HasPrefix(ref, "snd_") {
+		t.Fatalf("send response reference %q (%s)", ref, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "参考编号："+ref) {
+		t.Errorf("reference %s missing from the audit log:\n%s", ref, logs.String())
+	}
+	if strings.Contains(ref, storedCode(t, "13800138000")) {
+		t.Error("reference contains the code")
+	}
+}
+
+func TestTrustedCallerBypassesCooldown(t *testing.T) {
+	const apiKey = "internal-key-0123456789abcdef0123"
+	tests := []struct {
+		name    string
+		env     []string
+		headers []string
+		bypass  bool
+	}{
+		{"internal CIDR", []string{"CAPTCHA_INTERNAL_CIDRS=192.0.2.0/24"}, nil, true},
+		{"API key", []string{"CAPTCHA_INTERNAL_API_KEY=" + apiKey}, []string{"X-Internal-Api-Key", apiKey}, true},
+		{"wrong API key", []string{"CAPTCHA_INTERNAL_API_KEY=" + apiKey}, []string{"X-Internal-Api-Key", "guess"}, false},
+		{"spoofed X-Forwarded-For", []string{"CAPTCHA_INTERNAL_CIDRS=10.0.0.0/8"}, []string{"X-Forwarded-For", "10.0.0.1"}, false},
+		{"normal caller", nil, nil, false},
+	}
+	for _, tt := range tests {
+		setupTest(t, tt.env...)
+		logs := captureLog(t)
+		phone := "13800138000"
+		sendCaptcha(phone, tt.headers...)
+		w := sendCaptcha(phone, tt.headers...)
+		if bypassed := w.Code == http.StatusOK; bypassed != tt.bypass {
+			t.Errorf("%s: second send status %d, bypass %v, want %v", tt.name, w.Code, bypassed, tt.bypass)
+		}
+		if audited := strings.Contains(logs.String(), "跳过发送限制"); audited != tt.bypass {
+			t.Errorf("%s: bypass audit logged %v, want %v", tt.name, audited, tt.bypass)
+		}
+	}
+}
+
+func TestIsExpiredBoundary(t *testing.T) {
+	expireAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	info := CaptchaInfo{ExpireAt: expireAt}
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{"just before", expireAt.Add(-time.Nanosecond), false},
+		{"exactly at", expireAt, true},
+		{"just after", expireAt.Add(time.Nanosecond), true},
+	}
+	for _, tt := range tests {
+		if got := isExpired(info, tt.now); got != tt.want {
+			t.Errorf("%s expiry: isExpired = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCaptchaConfigMatchesActiveConfig(t *testing.T) {
+	path := t.TempDir() + "/captcha.json"
+	writeConfigFile(t, path, `{"captcha_ttl":"3m","send_cooldown":"45s"}`)
+	setupTest(t, "CAPTCHA_CONFIG_FILE="+path, "CAPTCHA_CODE_LENGTH=8", "CAPTCHA_CODE_CHARSET=ABCDEFGHJKLMNPQRSTUVWXYZ23456789")
+
+	w := doRequest(captchaConfigHandler, http.MethodGet, "")
+	resp := decodeResponse(t, w)
+	want := map[string]interface{}{
+		"code":             0.0,
+		"code_length":      8.0,
+		"min_code_length":  8.0,
+		"max_code_length":  8.0,
+		"numeric":          false,
+		"ttl_seconds":      180.0,
+		"cooldown_seconds": 45.0,
+	}
+	if len(resp) != len(want) {
+		t.Errorf("captcha-config returned unexpected fields: %s", w.Body.String())
+	}
+	for key, value := range want {
+		if resp[key] != value {
+			t.Errorf("%s = %v, want %v", key, resp[key], value)
+		}
+	}
+}
+
+// 走一遍会记录手机号的主要流程：发送、内部调用方跳过限制、超出窗口次数、设备不一致、验证
+func exercisePhoneLogging(t *testing.T, phone string) {
+	t.Helper()
+	sendCaptcha(phone, "User-Agent", "app/1.0")
+	sendCaptcha(phone, "X-Internal-Api-Key", "internal-key-0123456789abcdef0123")
+	backdateSend(phone, 2*time.Minute)
+	if w := sendCaptcha(phone); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("send beyond the window limit: status %d", w.Code)
+	}
+	verify(phone, storedCode(t, phone), "User-Agent", "other-device/2.0")
+}
+
+func TestLogsNeverContainRawPhone(t *testing.T) {
+	phone := "13800138000"
+	base := []string{
+		"CAPTCHA_INTERNAL_API_KEY=internal-key-0123456789abcdef0123",
+		"CAPTCHA_SEND_WINDOW_LIMIT=1",
+		"CAPTCHA_FINGERPRINT_BINDING=soft",
+	}
+	tests := []struct {
+		mode string
+		env  []string
+		want string
+	}{
+		{"mask", nil, "138****8000"},
+		{"hash", []string{"CAPTCHA_LOG_PHONE_MODE=hash", "CAPTCHA_LOG_PHONE_SALT=0123456789abcdef"}, "h:"},
+	}
+	for _, tt := range tests {
+		setupTest(t, append(base, tt.env...)...)
+		if tt.mode == "hash" {
+			tt.want = hashPhone(phone)
+		}
+		logs := captureLog(t)
+		exercisePhoneLogging(t, phone)
+
+		out := logs.String()
+		if strings.Contains(out, phone) {
+			t.Errorf("%s mode: raw phone in logs:\n%s", tt.mode, out)
+		}
+		if strings.Count(out, tt.want) < 5 {
+			t.Errorf("%s mode: expected %q on every phone log line:\n%s", tt.mode, tt.want, out)
+		}
+	}
+}
+
+func TestIdempotentSendReplaysResult(t *testing.T) {
+	path := t.TempDir() + "/captcha.json"
+	writeConfigFile(t, path, `{"send_cooldown":"0s"}`)
+	setupTest(t, "CAPTCHA_CONFIG_FILE="+path)
+	logs := captureLog(t)
+	phone := "13800138000"
+
+	first := sendCaptcha(phone, "Idempotency-Key", "retry-1")
+	second := sendCaptcha(phone, "Idempotency-Key", "retry-1")
+	if first.Code != http.StatusOK || second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Fatalf("replayed send differs: %d %s vs %d %s", first.Code, first.Body.String(), second.Code, second.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replayed response lacks Idempotent-Replayed")
+	}
+	if first.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("original response marked as replayed")
+	}
+	if n := strings.Count(logs.String(), "过期时间："); n != 1 {
+		t.Errorf("same key delivered %d SMS, want 1", n)
+	}
+
+	third := sendCaptcha(phone, "Idempotency-Key", "retry-2")
+	if third.Code != http.StatusOK || third.Body.String() == first.Body.String() {
+		t.Errorf("send with a new key: status %d (%s)", third.Code, third.Body.String())
+	}
+	if n := strings.Count(logs.String(), "过期时间："); n != 2 {
+		t.Errorf("two keys delivered %d SMS, want 2", n)
+	}
+}
+
+func TestPrettyJSONOnlyInDebugMode(t *testing.T) {
+	tests := []struct {
+		env    []string
+		query  string
+		indent bool
+	}{
+		{[]string{"CAPTCHA_DEBUG=true"}, "?pretty=true", true},
+		{[]string{"CAPTCHA_DEBUG=true"}, "", false},
+		{nil, "?pretty=true", false},
+	}
+	for _, tt := range tests {
+		setupTest(t, tt.env...)
+		w := httptest.NewRecorder()
+		captchaConfigHandler(w, httptest.NewRequest(http.MethodGet, "/api/captcha-config"+tt.query, nil))
+		if indented := strings.Contains(w.Body.String(), "\n  \""); indented != tt.indent {
+			t.Errorf("%v %q: indented %v, want %v (%s)", tt.env, tt.query, indented, tt.indent, w.Body.String())
+		}
+		decodeResponse(t, w)
+	}
+}
+
+// 取一个挑战并暴力求解，返回带挑战和解的发送请求体
+func solveChallenge(t *testing.T, phone string) (token, solution string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/challenge?phone="+phone, nil)
+	w := httptest.NewRecorder()
+	challengeHandler(w, r)
+	resp := decodeResponse(t, w)
+	token, _ = resp["challenge"].(string)
+	difficulty := int(resp["difficulty"].(float64))
+	for i := 0; ; i++ {
+		solution = strconv.Itoa(i)
+		if sum := sha256.Sum256([]byte(token + ":" + solution)); leadingZeroBits(sum[:]) >= difficulty {
+			return token, solution
+		}
+	}
+}
+
+func sendWithChallenge(phone, token, solution string) *httptest.ResponseRecorder {
+	return doRequest(sendCaptchaHandler, http.MethodPost, `{"phone":"`+phone+`","challenge":"`+token+`","solution":"`+solution+`"}`)
+}
+
+func TestSendRequiresChallengeSolution(t *testing.T) {
+	setupTest(t, "CAPTCHA_CHALLENGE_DIFFICULTY=8", testTokenSecret)
+	phone := "13800138000"
+
+	if w := sendCaptcha(phone); w.Code != http.StatusBadRequest {
+		t.Errorf("send without a challenge: status %d, want 400", w.Code)
+	}
+	token, solution := solveChallenge(t, phone)
+	wrong := solution
+	for i := 0; ; i++ {
+		wrong = "x" + strconv.Itoa(i)
+		if sum := sha256.Sum256([]byte(token + ":" + wrong)); leadingZeroBits(sum[:]) < 8 {
+			break
+		}
+	}
+	if w := sendWithChallenge(phone, token, wrong); w.Code != http.StatusBadRequest {
+		t.Errorf("send with a wrong solution: status %d, want 400", w.Code)
+	}
+	if w := sendWithChallenge(phone, token, solution); w.Code != http.StatusOK {
+		t.Fatalf("send with the solution: status %d (%s)", w.Code, w.Body.String())
+	}
+	if w := sendWithChallenge("13900139000", token, solution); w.Code != http.StatusBadRequest {
+		t.Errorf("challenge reused for another phone: status %d, want 400", w.Code)
+	}
+}
+
+func TestChallengeCannotBeReused(t *testing.T) {
+	path := t.TempDir() + "/captcha.json"
+	writeConfigFile(t, path, `{"send_cooldown":"0s"}`)
+	setupTest(t, "CAPTCHA_CHALLENGE_DIFFICULTY=4", testTokenSecret, "CAPTCHA_CONFIG_FILE="+path)
+	phone := "13800138000"
+
+	token, solution := solveChallenge(t, phone)
+	if w := sendWithChallenge(phone, token, solution); w.Code != http.StatusOK {
+		t.Fatalf("first send: status %d (%s)", w.Code, w.Body.String())
+	}
+	if w := sendWithChallenge(phone, token, solution); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "already used") {
+		t.Errorf("replayed challenge: status %d (%s)", w.Code, w.Body.String())
+	}
+
+	pruneSpentChallenges(time.Now().Add(challengeTTL + time.Second))
+	noncesMu.Lock()
+	remaining := len(spentChallenges)
+	noncesMu.Unlock()
+	if remaining != 0 {
+		t.Errorf("%d spent challenges left after expiry", remaining)
+	}
+}
+
+func TestVerifyAcceptsNumericCode(t *testing.T) {
+	for _, code := range []string{`"123456"`, `123456`} {
+		setupTest(t)
+		codeRandom = bytes.NewReader([]byte{1, 2, 3, 4, 5, 6})
+		phone := "13800138000"
+		sendCaptcha(phone)
+		if w := doRequest(verifyCaptchaHandler, http.MethodPost, `{"phone":"`+phone+`","code":`+code+`}`); w.Code != http.StatusOK {
+			t.Errorf("verify with code %s: status %d (%s)", code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestVerifyRejectsNonIntegerCode(t *testing.T) {
+	for _, code := range []string{`1.5`, `-123456`, `true`, `[1]`} {
+		var req VerifyCaptchaRequest
+		if err := json.Unmarshal([]byte(`{"phone":"13800138000","code":`+code+`}`), &req); err == nil {
+			t.Errorf("code %s decoded as %q", code, req.Code)
+		}
+	}
+}
+
+func TestFormattedPhonesShareStoredKey(t *testing.T) {
+	setupTest(t)
+	for _, raw := range []string{"138-0013-8000", "(138) 0013 8000", "+86 138.0013.8000", " 138 0013 8000 ", "138\u00a00013\u00a08000"} {
+		if phone, ok := normalizePhone(raw); !ok || phone != "13800138000" {
+			t.Errorf("normalizePhone(%q) = %q, %v", raw, phone, ok)
+		}
+	}
+
+	sendCaptcha("(138) 0013 8000")
+	if w := verify("138-0013-8000", storedCode(t, "13800138000")); w.Code != http.StatusOK {
+		t.Errorf("verify with a different format: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestPhoneFormatCharsConfigurable(t *testing.T) {
+	setupTest(t, "CAPTCHA_PHONE_FORMAT_CHARS=")
+	if _, ok := normalizePhone("138-0013-8000"); ok {
+		t.Error("dashes stripped with formatting disabled")
+	}
+	setupTest(t, "CAPTCHA_PHONE_FORMAT_CHARS=/")
+	if phone, ok := normalizePhone("138/0013/8000"); !ok || phone != "13800138000" {
+		t.Errorf("custom format char: %q, %v", phone, ok)
+	}
+	if err := loadTestConfig(t, "CAPTCHA_PHONE_FORMAT_CHARS=+-"); err == nil {
+		t.Error("format chars containing + accepted")
+	}
+}
+
+func preissue(body string) *httptest.ResponseRecorder {
+	return doRequest(preissueCaptchaHandler, http.MethodPost, body, "Authorization", "Bearer admin-token")
+}
+
+// 把验证码的发送和过期时间一起往前推，模拟签发后过了一段时间
+func age(phone string, d time.Duration) {
+	mu.Lock()
+	info := captchaStore[phone]
+	info.SentAt = info.SentAt.Add(-d)
+	info.ExpireAt = info.ExpireAt.Add(-d)
+	captchaStore[phone] = info
+	mu.Unlock()
+}
+
+func TestPreissuedCodeVerifiesAfterLongDelay(t *testing.T) {
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=ops:admin-token")
+	phone := "13800138000"
+
+	w := preissue(`{"phones":["` + phone + `","12345"],"ttl":"168h"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("preissue: status %d (%s)", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Results []map[string]interface{} `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Results) != 2 {
+		t.Fatalf("preissue response: %s", w.Body.String())
+	}
+	if _, ok := resp.Results[0]["expire_at"]; !ok {
+		t.Error("issued entry has no expire_at")
+	}
+
+	// 远超普通验证码有效期后仍可验证
+	age(phone, 48*time.Hour)
+	if w := verify(phone, resp.Results[0]["code"].(string)); w.Code != http.StatusOK {
+		t.Errorf("verify two days after preissue: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestSendDoesNotOverwritePreissuedCode(t *testing.T) {
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=ops:admin-token")
+	phone := "13800138000"
+	preissue(`{"phones":["` + phone + `"],"ttl":"168h"}`)
+	code := storedCode(t, phone)
+
+	if w := sendCaptcha(phone); w.Code != http.StatusConflict {
+		t.Errorf("public send over a pending preissued code: status %d, want 409", w.Code)
+	}
+	if got := storedCode(t, phone); got != code {
+		t.Fatalf("preissued code replaced by %q", got)
+	}
+
+	// 线下验证码过期后恢复正常发送
+	age(phone, 169*time.Hour)
+	if w := sendCaptcha(phone); w.Code != http.StatusOK {
+		t.Errorf("send after the preissued code expired: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestRevokePreissuedCode(t *testing.T) {
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=ops:admin-token")
+	phone := "13800138000"
+	preissue(`{"phones":["` + phone + `"],"ttl":"720h"}`)
+	code := storedCode(t, phone)
+	revoke := func(headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, "/api/admin/preissue?phone="+phone, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		preissueCaptchaHandler(w, r)
+		return w
+	}
+
+	if w := revoke(); w.Code != http.StatusUnauthorized {
+		t.Fatalf("revoke without token: status %d, want 401", w.Code)
+	}
+	if w := revoke("Authorization", "Bearer admin-token"); w.Code != http.StatusOK {
+		t.Fatalf("revoke: status %d (%s)", w.Code, w.Body.String())
+	}
+	if w := verify(phone, code); w.Code == http.StatusOK {
+		t.Error("revoked preissued code still verifies")
+	}
+	if w := sendCaptcha(phone); w.Code != http.StatusOK {
+		t.Fatalf("send after revoking: status %d (%s)", w.Code, w.Body.String())
+	}
+
+	// 短信发出的验证码不能通过撤销接口删除
+	if w := revoke("Authorization", "Bearer admin-token"); w.Code != http.StatusNotFound {
+		t.Errorf("revoke an SMS code: status %d, want 404", w.Code)
+	}
+	storedCode(t, phone)
+}
+
+func TestPreissueInvalidEntryOmitsExpireAt(t *testing.T) {
+	setupTest(t, "CAPTCHA_ADMIN_TOKENS=ops:admin-token")
+	w := preissue(`{"phones":["12345"]}`)
+	var resp struct {
+		Results []map[string]interface{} `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Results) != 1 {
+		t.Fatalf("preissue response: %s", w.Body.String())
+	}
+	if _, ok := resp.Results[0]["expire_at"]; ok {
+		t.Errorf("invalid entry carries a zero expire_at: %v", resp.Results[0])
+	}
+}
+
+func TestPruneSendHistory(t *testing.T) {
+	setupTest(t, "CAPTCHA_SEND_WINDOW=1h", "CAPTCHA_SEND_HISTORY_MARGIN=10m")
+	now := time.Now()
+	sendHistoryMu.Lock()
+	sendHistory["13800138000"] = []time.Time{now.Add(-2 * time.Hour)}
+	sendHistory["13900139000"] = []time.Time{now.Add(-2 * time.Hour), now.Add(-5 * time.Minute)}
+	sendHistoryMu.Unlock()
+
+	pruneSendHistory(now)
+
+	sendHistoryMu.Lock()
+	defer sendHistoryMu.Unlock()
+	if _, ok := sendHistory["13800138000"]; ok {
+		t.Error("inactive phone kept in send history")
+	}
+	if got := sendHistory["13900139000"]; len(got) != 1 || !got[0].Equal(now.Add(-5*time.Minute)) {
+		t.Errorf("active phone history = %v, want only the recent send", got)
+	}
+}
+
+func TestResubmitAfterVerifyReportsAlreadyVerified(t *testing.T) {
+	setupTest(t, "CAPTCHA_ALREADY_VERIFIED_WINDOW=10m")
+	phone := "13800138000"
+	sendCaptcha(phone)
+	code := storedCode(t, phone)
+	if w := verify(phone, code); w.Code != http.StatusOK {
+		t.Fatalf("verify: status %d (%s)", w.Code, w.Body.String())
+	}
+
+	w := verify(phone, code)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), alreadyVerifiedMsg) {
+		t.Errorf("resubmit of the same code: status %d (%s), want 409", w.Code, w.Body.String())
+	}
+}
+
+// 其他验证码不能借此确认号码刚验证过
+func TestResubmitOfDifferentCodeNotAlreadyVerified(t *testing.T) {
+	setupTest(t, "CAPTCHA_ALREADY_VERIFIED_WINDOW=10m")
+	phone := "13800138000"
+	sendCaptcha(phone)
+	code := storedCode(t, phone)
+	verify(phone, code)
+
+	if w := verify(phone, wrongCode(code)); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Captcha not found") {
+		t.Errorf("resubmit of a different code: status %d (%s), want 400 not found", w.Code, w.Body.String())
+	}
+}
+
+func TestAlreadyVerifiedOffByDefault(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+	sendCaptcha(phone)
+	code := storedCode(t, phone)
+	verify(phone, code)
+
+	if w := verify(phone, code); w.Code != http.StatusBadRequest {
+		t.Errorf("resubmit with the window off: status %d, want 400", w.Code)
+	}
+}
+
+func TestStatelessResubmitReportsAlreadyVerified(t *testing.T) {
+	setupTest(t, "CAPTCHA_STATELESS=true", testTokenSecret, "CAPTCHA_ALREADY_VERIFIED_WINDOW=10m")
+	phone := "13800138000"
+	token, code := sendStateless(t, phone)
+	if w := verifyStateless(phone, code, token); w.Code != http.StatusOK {
+		t.Fatalf("stateless verify: status %d (%s)", w.Code, w.Body.String())
+	}
+
+	if w := verifyStateless(phone, code, token); w.Code != http.StatusConflict {
+		t.Errorf("resubmit of the same code: status %d, want 409", w.Code)
+	}
+	if w := verifyStateless(phone, wrongCode(code), token); w.Code != http.StatusBadRequest {
+		t.Errorf("resubmit of a different code: status %d, want 400", w.Code)
+	}
+}
+
+func TestTestPhoneBypassesCooldown(t *testing.T) {
+	setupTest(t, "CAPTCHA_ENV=development", "CAPTCHA_TEST_PHONES=1990000*", "CAPTCHA_TEST_PHONE_CODE=000000")
+
+	for i := 0; i < 3; i++ {
+		if w := sendCaptcha("19900001234"); w.Code != http.StatusOK {
+			t.Fatalf("send %d to test phone: status %d (%s)", i+1, w.Code, w.Body.String())
+		}
+	}
+	if code := storedCode(t, "19900001234"); code != "000000" {
+		t.Errorf("test phone code %q, want the fixed 000000", code)
+	}
+
+	sendCaptcha("13800138000")
+	if w := sendCaptcha("13800138000"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("resend to a normal phone: status %d, want 429", w.Code)
+	}
+	if code := storedCode(t, "13800138000"); code == "000000" {
+		t.Error("normal phone got the fixed test code")
+	}
+}
+
+func TestTestPhonesRejectedInProduction(t *testing.T) {
+	if err := loadTestConfig(t, "CAPTCHA_TEST_PHONES=1990000*"); err == nil {
+		t.Error("test phones accepted in production")
+	}
+	// 即使跳过启动校验，生产环境也不把号码当作测试号码
+	setupTest(t, "CAPTCHA_ENV=development", "CAPTCHA_TEST_PHONES=1990000*")
+	appEnv = "production"
+	if isTestPhone("19900001234") {
+		t.Error("isTestPhone true in production")
+	}
+}
+
+func decodeVerifyBody(body string) (VerifyCaptchaRequest, *captchaError) {
+	var req VerifyCaptchaRequest
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	err := decodeRequestBody(httptest.NewRecorder(), r, &req)
+	return req, err
+}
+
+func TestInvalidUTF8Rejected(t *testing.T) {
+	setupTest(t)
+	for _, body := range []string{
+		"{\"phone\":\"13800138000\",\"code\":\"12\xff456\"}",
+		`{"phone":"13800138000","code":"12\ud800456"}`,
+	} {
+		if _, err := decodeVerifyBody(body); err == nil || err.status != http.StatusBadRequest {
+			t.Errorf("body %q: error %v, want 400", body, err)
+		}
+		if w := doRequest(verifyCaptchaHandler, http.MethodPost, body); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "not valid UTF-8") {
+			t.Errorf("verify with %q: status %d (%s)", body, w.Code, w.Body.String())
+		}
+	}
+	if _, err := decodeVerifyBody(`{"phone":"13800138000","code":"\ud83d\ude00"}`); err != nil {
+		t.Errorf("valid surrogate pair rejected: %v", err)
+	}
+}
+
+func TestInvalidUTF8Sanitized(t *testing.T) {
+	setupTest(t, "CAPTCHA_INVALID_UTF8=sanitize")
+	for _, body := range []string{
+		"{\"phone\":\"13800138000\",\"code\":\"12\xff456\"}",
+		`{"phone":"13800138000","code":"12\ud800456"}`,
+	} {
+		req, err := decodeVerifyBody(body)
+		if err != nil || req.Code != "12\uFFFD456" {
+			t.Errorf("body %q: code %q, error %v, want replacement character", body, req.Code, err)
+		}
+	}
+}
+
+func verifyWithAnswer(phone, code, answer string) *httptest.ResponseRecorder {
+	return doRequest(verifyCaptchaHandler, http.MethodPost, `{"phone":"`+phone+`","code":"`+code+`","secret_answer":"`+answer+`"}`)
+}
+
+func TestSecretAnswerFailuresAreIndistinguishable(t *testing.T) {
+	setupTest(t, "CAPTCHA_REQUIRE_SECRET_ANSWER=true", "CAPTCHA_ADMIN_TOKENS=ops:admin-token")
+	phone := "13800138000"
+	w := doRequest(secretAnswerHandler, http.MethodPut, `{"phone":"`+phone+`","answer":"Blue Whale"}`, "Authorization", "Bearer admin-token")
+	if w.Code != http.StatusOK {
+		t.Fatalf("set secret answer: status %d (%s)", w.Code, w.Body.String())
+	}
+	sendCaptcha(phone)
+	code := storedCode(t, phone)
+
+	wrongCodeResp := verifyWithAnswer(phone, wrongCode(code), "Blue Whale")
+	wrongAnswerResp := verifyWithAnswer(phone, code, "red panda")
+	if wrongCodeResp.Code != http.StatusBadRequest || wrongCodeResp.Code != wrongAnswerResp.Code ||
+		wrongCodeResp.Body.String() != wrongAnswerResp.Body.String() {
+		t.Errorf("failures differ: wrong code %d %q, wrong answer %d %q",
+			wrongCodeResp.Code, wrongCodeResp.Body.String(), wrongAnswerResp.Code, wrongAnswerResp.Body.String())
+	}
+
+	// 答案忽略首尾空格和大小写
+	if w := verifyWithAnswer(phone, code, " blue whale "); w.Code != http.StatusOK {
+		t.Errorf("both correct: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	setupTest(t)
+	h := withCorrelationID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(id string) (string, string) {
+		logs := captureLog(t)
+		r := httptest.NewRequest(http.MethodGet, "/api/captcha-config", nil)
+		if id != "" {
+			r.Header.Set("X-Correlation-ID", id)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Header().Get("X-Correlation-ID"), logs.String()
+	}
+
+	if got, logs := serve("trace-42.abc"); got != "trace-42.abc" || !strings.Contains(logs, "关联 ID：trace-42.abc") {
+		t.Errorf("client ID echoed as %q, log %q", got, logs)
+	}
+	for _, id := range []string{"", "bad id\nInjected", strings.Repeat("a", 65)} {
+		got, logs := serve(id)
+		if got == id || !correlationIDRegex.MatchString(got) || !strings.Contains(logs, got) {
+			t.Errorf("ID %q: response carries %q, log %q", id, got, logs)
+		}
+	}
+}
+
+func TestCorrelationHeaderConfigurable(t *testing.T) {
+	setupTest(t, "CAPTCHA_CORRELATION_HEADER=x-request-id")
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	withCorrelationID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+	if got := w.Header().Get("X-Request-Id"); got != "req-1" {
+		t.Errorf("configured header echoed %q", got)
+	}
+}
+
+func TestSecureVerifyFailuresIdentical(t *testing.T) {
+	setupTest(t, "CAPTCHA_SECURE_VERIFY_ERRORS=true", "CAPTCHA_SECURE_VERIFY_MIN_DURATION=20ms")
+	sendCaptcha("13800138000")
+	code := storedCode(t, "13800138000")
+	sendCaptcha("13900139000")
+	age("13900139000", time.Hour)
+
+	cases := []struct{ reason, phone, code string }{
+		{"not found", "13700137000", "123456"},
+		{"expired", "13900139000", "123456"},
+		{"invalid code", "13800138000", wrongCode(code)},
+		{"wrong length", "13800138000", "1234"},
+		{"invalid phone", "12345", "123456"},
+	}
+	var first *httptest.ResponseRecorder
+	for _, tc := range cases {
+		start := time.Now()
+		w := verify(tc.phone, tc.code)
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Errorf("%s: answered in %s, before the minimum duration", tc.reason, elapsed)
+		}
+		if first == nil {
+			first = w
+		}
+		if w.Code != http.StatusBadRequest || w.Body.String() != first.Body.String() || !strings.Contains(w.Body.String(), secureVerifyFailedMsg) {
+			t.Errorf("%s: status %d (%q), want the generic failure", tc.reason, w.Code, w.Body.String())
+		}
+	}
+
+	verifyFailuresMu.Lock()
+	defer verifyFailuresMu.Unlock()
+	if verifyFailures["Captcha not found"] == 0 || verifyFailures["Captcha expired"] == 0 || verifyFailures["Invalid phone number"] == 0 {
+		t.Errorf("specific reasons not recorded: %v", verifyFailures)
+	}
+}
+
+func TestSecureVerifyLogsNormalizedPhone(t *testing.T) {
+	setupTest(t, "CAPTCHA_SECURE_VERIFY_ERRORS=true", "CAPTCHA_SECURE_VERIFY_MIN_DURATION=0s",
+		"CAPTCHA_LOG_PHONE_MODE=hash", "CAPTCHA_LOG_PHONE_SALT=0123456789abcdef")
+	logs := captureLog(t)
+
+	verify("13800138000", "123456")
+	verify("138-0013-8000", "123456")
+	verify("not a phone", "123456")
+
+	out := logs.String()
+	if n := strings.Count(out, "验证失败（手机号："+hashPhone("13800138000")+"）"); n != 2 {
+		t.Errorf("normalized hash logged %d times, want 2:\n%s", n, out)
+	}
+	if !strings.Contains(out, "验证失败（手机号：invalid）") || strings.Contains(out, "not a phone") {
+		t.Errorf("invalid phone not replaced by a placeholder:\n%s", out)
+	}
+}
+
+// 以当前时间为基准生成 HH:MM-HH:MM 的时段，from、to 为相对当前时间的偏移
+func quietWindow(from, to time.Duration) string {
+	now := time.Now().UTC()
+	return now.Add(from).Format("15:04") + "-" + now.Add(to).Format("15:04")
+}
+
+func TestSendPausedDuringQuietHours(t *testing.T) {
+	setupTest(t, "CAPTCHA_QUIET_HOURS="+quietWindow(-time.Hour, time.Hour), "CAPTCHA_QUIET_HOURS_TZ=UTC")
+
+	w := sendCaptcha("13800138000")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("send in quiet hours: status %d, want 503", w.Code)
+	}
+	retry, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retry <= 0 || retry > 3600 {
+		t.Errorf("Retry-After %q, want seconds until the window ends", w.Header().Get("Retry-After"))
+	}
+	mu.RLock()
+	stored := len(captchaStore)
+	mu.RUnlock()
+	if stored != 0 {
+		t.Error("a code was generated during quiet hours")
+	}
+}
+
+func TestSendAllowedOutsideQuietHours(t *testing.T) {
+	setupTest(t, "CAPTCHA_QUIET_HOURS="+quietWindow(2*time.Hour, 3*time.Hour), "CAPTCHA_QUIET_HOURS_TZ=UTC")
+
+	if w := sendCaptcha("13800138000"); w.Code != http.StatusOK {
+		t.Errorf("send outside quiet hours: status %d (%s)", w.Code, w.Body.String())
+	}
+}
+
+func TestRateLimitResponsesAreStructured(t *testing.T) {
+	phone := "13800138000"
+	attemptsConfig := t.TempDir() + "/captcha.json"
+	writeConfigFile(t, attemptsConfig, `{"max_verify_attempts":3}`)
+	tests := []struct {
+		limit    string
+		env      []string
+		trigger  func() *httptest.ResponseRecorder
+		max      float64
+		hasReset bool
+	}{
+		{"cooldown", nil, func() *httptest.ResponseRecorder {
+			sendCaptcha(phone)
+			return sendCaptcha(phone)
+		}, 1, true},
+		{"send_window", []string{"CAPTCHA_SEND_WINDOW_LIMIT=1"}, func() *httptest.ResponseRecorder {
+			sendCaptcha(phone)
+			backdateSend(phone, 2*time.Minute)
+			return sendCaptcha(phone)
+		}, 1, true},
+		{"ip", nil, func() *httptest.ResponseRecorder {
+			var w *httptest.ResponseRecorder
+			for i := 0; i <= 30; i++ {
+				w = doRequest(validatePhoneHandler, http.MethodPost, `{"phone":"`+phone+`"}`)
+			}
+			return w
+		}, 30, true},
+		{"verify_attempts", []string{"CAPTCHA_CONFIG_FILE=" + attemptsConfig}, func() *httptest.ResponseRecorder {
+			sendCaptcha(phone)
+			return exhaustAttempts(phone, wrongCode(storedCode(t, phone)))
+		}, 3, false},
+	}
+	for _, tt := range tests {
+		setupTest(t, tt.env...)
+		w := tt.trigger()
+		resp := decodeResponse(t, w)
+		if w.Code != http.StatusTooManyRequests || resp["limit"] != tt.limit || resp["max"] != tt.max || resp["used"] != tt.max {
+			t.Errorf("%s: status %d (%s)", tt.limit, w.Code, w.Body.String())
+		}
+		if _, ok := resp["reset_at"]; ok != tt.hasReset || (w.Header().Get("Retry-After") != "") != tt.hasReset {
+			t.Errorf("%s: reset_at present %v, Retry-After %q, want reset %v", tt.limit, ok, w.Header().Get("Retry-After"), tt.hasReset)
+		}
+		if msg, _ := resp["msg"].(string); msg == "" {
+			t.Errorf("%s: no msg", tt.limit)
+		}
+	}
+}
+
+func TestVerifyRetryWithinUsedCodeRetention(t *testing.T) {
+	setupTest(t, "CAPTCHA_USED_CODE_RETENTION=1m")
+	phone := "13800138000"
+	sendCaptcha(phone)
+	code := storedCode(t, phone)
+
+	if w := verify(phone, code); w.Code != http.StatusOK {
+		t.Fatalf("verify: status %d (%s)", w.Code, w.Body.String())
+	}
+	// 客户端没收到结果后重试
+	if w := verify(phone, code); w.Code != http.StatusOK {
+		t.Errorf("retry within retention: status %d (%s)", w.Code, w.Body.String())
+	}
+	if w := verify(phone, wrongCode(code)); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "already used") {
+		t.Errorf("different code within retention: status %d (%s)", w.Code, w.Body.String())
+	}
+	mu.RLock()
+	attempts := captchaStore[phone].Attempts
+	mu.RUnlock()
+	if attempts != 0 {
+		t.Errorf("rejected code on a used captcha counted as %d failed attempts", attempts)
+	}
+
+	age(phone, time.Minute)
+	pruneExpiredCaptchas(time.Now())
+	if w := verify(phone, code); w.Code == http.StatusOK {
+		t.Error("retry after the retention window succeeded")
+	}
+}
+
+func TestUsedCodeDeletedWithoutRetention(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+	sendCaptcha(phone)
+	code := storedCode(t, phone)
+	verify(phone, code)
+
+	if w := verify(phone, code); w.Code == http.StatusOK {
+		t.Error("retry without retention succeeded")
+	}
+}
+
+func preflight(origin string) *httptest.ResponseRecorder {
+	return doRequest(allowMethods(sendCaptchaHandler, http.MethodPost), http.MethodOptions, "",
+		"Origin", origin, "Access-Control-Request-Method", http.MethodPost)
+}
+
+func TestCORSMaxAgePerOrigin(t *testing.T) {
+	setupTest(t, "CAPTCHA_CORS_MAX_AGE=10m",
+		"CAPTCHA_CORS_MAX_AGE_BY_ORIGIN=https://app.example.com=1h,https://admin.example.com=30s")
+
+	for _, tt := range []struct {
+		origin, want string
+	}{
+		{"https://app.example.com", "3600"},
+		{"https://admin.example.com", "30"},
+		{"https://other.example.com", "600"}, // 未单独配置的来源使用全局值
+	} {
+		w := preflight(tt.origin)
+		if got := w.Header().Get("Access-Control-Max-Age"); got != tt.want {
+			t.Errorf("%s: max-age %q, want %q", tt.origin, got, tt.want)
+		}
+		if v := w.Header().Values("Vary"); len(v) != 1 || v[0] != "Origin" {
+			t.Errorf("%s: Vary %q, want Origin", tt.origin, v)
+		}
+	}
+
+	// 不带 Origin 的响应同样随来源变化，需要 Vary
+	w := doRequest(allowMethods(captchaConfigHandler, http.MethodGet), http.MethodGet, "")
+	if w.Header().Get("Vary") != "Origin" {
+		t.Errorf("request without Origin: Vary %q, want Origin", w.Header().Get("Vary"))
+	}
+}
+
+func TestCORSMaxAgeGlobalOnly(t *testing.T) {
+	setupTest(t, "CAPTCHA_CORS_MAX_AGE=10m")
+	w := preflight("https://app.example.com")
+	if got := w.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("max-age %q, want 600", got)
+	}
+	// 响应与来源无关（Allow-Origin 为 *），不需要 Vary
+	if v := w.Header().Get("Vary"); v != "" {
+		t.Errorf("Vary %q on an origin-independent response", v)
+	}
+	if err := loadTestConfig(t, "CAPTCHA_CORS_MAX_AGE_BY_ORIGIN=https://app.example.com"); err == nil {
+		t.Error("entry without a duration accepted")
+	}
+}
+
+func TestNewCodeDiffersFromPrevious(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+	codeRandom = bytes.NewReader([]byte{1, 2, 3, 4, 5, 6})
+	first, err := codeForPhone(phone, 6)
+	if err != nil || first != "123456" {
+		t.Fatalf("first code %q, %v", first, err)
+	}
+
+	// 第一次生成与上一次相同，重新生成后得到不同的验证码
+	codeRandom = bytes.NewReader([]byte{1, 2, 3, 4, 5, 6, 6, 5, 4, 3, 2, 1})
+	if second, err := codeForPhone(phone, 6); err != nil || second != "654321" {
+		t.Errorf("code after a forced collision %q, %v, want 654321", second, err)
+	}
+
+	// 其他号码不受影响
+	codeRandom = bytes.NewReader([]byte{1, 2, 3, 4, 5, 6})
+	if other, _ := codeForPhone("13900139000", 6); other != "123456" {
+		t.Errorf("other phone code %q, want 123456", other)
+	}
+}
+
+func TestCodeRegenerationIsBounded(t *testing.T) {
+	setupTest(t)
+	phone := "13800138000"
+	codeRandom = bytes.NewReader([]byte{1, 2, 3, 4, 5, 6})
+	codeForPhone(phone, 6)
+
+	// 每次都生成相同的验证码时，重试有限次数后照常使用
+	codeRandom = bytes.NewReader(bytes.Repeat([]byte{1, 2, 3, 4, 5, 6}, maxCodeGenerateAttempts))
+	if code, err := codeForPhone(phone, 6); err != nil || code != "123456" {
+		t.Errorf("code after exhausting attempts %q, %v", code, err)
+	}
+}
+
+// 关闭冷却期后向同一号码连续发送 n 次，返回日志中打印验证码的行数
+func countLoggedCodes(t *testing.T, n int, env ...string) int {
+	t.Helper()
+	path := t.TempDir() + "/captcha.json"
+	writeConfigFile(t, path, `{"send_cooldown":"0s"}`)
+	setupTest(t, append(env, "CAPTCHA_CONFIG_FILE="+path)...)
+	logs := captureLog(t)
+	for i := 0; i < n; i++ {
+		if w := sendCaptcha("13800138000"); w.Code != http.StatusOK {
+			t.Fatalf("send %d: status %d (%s)", i+1, w.Code, w.Body.String())
+		}
+	}
+	return strings.Count(logs.String(), "[debug] 验证码")
+}
+
+func TestDebugCodeLogSampling(t *testing.T) {
+	if n := countLoggedCodes(t, 3, "CAPTCHA_ENV=development"); n != 0 {
+		t.Errorf("code logged %d times with logging off", n)
+	}
+	if n := countLoggedCodes(t, 3, "CAPTCHA_ENV=development", "CAPTCHA_LOG_CODES=true"); n != 3 {
+		t.Errorf("code logged %d times without sampling, want 3", n)
+	}
+	if n := countLoggedCodes(t, 6, "CAPTCHA_ENV=development", "CAPTCHA_LOG_CODES=true", "CAPTCHA_LOG_CODES_SAMPLE_RATE=3"); n != 2 {
+		t.Errorf("code logged %d times at 1-in-3 sampling, want 2", n)
+	}
+}
+
+func TestDebugCodeLogNeverInProduction(t *testing.T) {
+	if err := loadTestConfig(t, "CAPTCHA_LOG_CODES=true"); err == nil {
+		t.Error("CAPTCHA_LOG_CODES accepted in production")
+	}
+	// 即使跳过启动校验也不打印
+	setupTest(t)
+	logCodes = true
+	logs := captureLog(t)
+	sendCaptcha("13800138000")
+	if strings.Contains(logs.String(), storedCode(t, "13800138000")) {
+		t.Errorf("code logged in production:\n%s", logs.String())
+	}
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test admin CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// 写出 CA 证书的 PEM 文件，返回路径
+func (ca *testCA) writePEM(t *testing.T) string {
+	t.Helper()
+	path := t.TempDir() + "/admin-ca.pem"
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// 签发用于客户端认证的证书
+func (ca *testCA) clientCert(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// 和生产环境一样只请求不强制客户端证书，用给定的证书和请求头访问管理接口
+func adminStatsOverTLS(t *testing.T, cert *tls.Certificate, headers ...string) int {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(allowMethods(statsHandler, http.MethodGet))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := srv.Client()
+	if cert != nil {
+		client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	r, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatalf("admin request: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdminClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	tlsEnv := []string{"CAPTCHA_TLS_CERT_FILE=server.pem", "CAPTCHA_TLS_KEY_FILE=server.key", "CAPTCHA_ADMIN_CLIENT_CA_FILE=" + ca.writePEM(t)}
+	valid := ca.clientCert(t, "ops")
+	untrusted := newTestCA(t).clientCert(t, "ops")
+	token := []string{"Authorization", "Bearer admin-token"}
+
+	setupTest(t, append(tlsEnv, "CAPTCHA_ADMIN_REQUIRE_CLIENT_CERT=true", "CAPTCHA_ADMIN_TOKENS=ops:admin-token")...)
+	if code := adminStatsOverTLS(t, &valid); code != http.StatusOK {
+		t.Errorf("valid client cert: status %d, want 200", code)
+	}
+	if code := adminStatsOverTLS(t, nil); code != http.StatusUnauthorized {
+		t.Errorf("no client cert: status %d, want 401", code)
+	}
+	if code := adminStatsOverTLS(t, &untrusted); code != http.StatusUnauthorized {
+		t.Errorf("cert from another CA: status %d, want 401", code)
+	}
+	if code := adminStatsOverTLS(t, nil, token...); code != http.StatusUnauthorized {
+		t.Errorf("token while certs are required: status %d, want 401", code)
+	}
+
+	// 不强制证书时令牌仍可作为替代
+	setupTest(t, append(tlsEnv, "CAPTCHA_ADMIN_TOKENS=ops:admin-token")...)
+	if code := adminStatsOverTLS(t, nil, token...); code != http.StatusOK {
+		t.Errorf("token without a cert: status %d, want 200", code)
+	}
+	if code := adminStatsOverTLS(t, &valid); code != http.StatusOK {
+		t.Errorf("valid client cert without a token: status %d, want 200", code)
+	}
+	if code := adminStatsOverTLS(t, nil); code != http.StatusUnauthorized {
+		t.Errorf("neither cert nor token: status %d, want 401", code)
+	}
+}
+
+func TestAdminClientCAConfigValidation(t *testing.T) {
+	if err := loadTestConfig(t, "CAPTCHA_ADMIN_CLIENT_CA_FILE="+newTestCA(t).writePEM(t)); err == nil {
+		t.Error("client CA accepted without TLS")
+	}
+	if err := loadTestConfig(t, "CAPTCHA_ADMIN_REQUIRE_CLIENT_CERT=true"); err == nil {
+		t.Error("required client certs accepted without a CA")
+	}
+}